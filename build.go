@@ -0,0 +1,264 @@
+package pbdb
+
+import (
+	"bytes"
+
+	"github.com/toba/pbdb/engine"
+	"github.com/toba/pbdb/index"
+	"github.com/toba/pbdb/store"
+)
+
+type (
+	// BuildOptions configure BuildIndex and RebuildIndex.
+	BuildOptions struct {
+		// BatchSize is the number of items indexed in each transaction.
+		// Writers are only blocked while a batch is indexed. Zero means
+		// DefaultBatchSize.
+		BatchSize int
+		// Progress is called after each batch is committed.
+		Progress func(BuildProgress)
+	}
+
+	// BuildProgress reports how much of an item bucket has been indexed.
+	BuildProgress struct {
+		// Scanned is the number of items read so far.
+		Scanned int
+		// Indexed is the number of items added to the index so far. Items
+		// without a value for the index are scanned but not indexed.
+		Indexed int
+		// Done indicates every item has been scanned.
+		Done bool
+	}
+)
+
+// DefaultBatchSize is the number of items indexed in each transaction when
+// BuildOptions.BatchSize is zero.
+const DefaultBatchSize = 1000
+
+// BuildIndex adds every item in the bucket of an example value to the index
+// named by a definition. Values come from the IndexMap of each stored item
+// so the definition must already be returned by the example type's IndexMap.
+// Only the definition's BucketName, Unique and Source are used.
+//
+// Items are indexed in batches, each in its own transaction, so writers may
+// change the bucket between batches. Saved items are indexed by the writer
+// so every item is indexed once the build is done. A failed build leaves
+// the batches already committed in place and may be run again.
+func (db *DB) BuildIndex(f DataFile, example store.Value, d *index.Definition, o *BuildOptions) error {
+	return buildIndex(func(fn TxFunc) error { return db.Update(f, fn) }, example, d, o)
+}
+
+// RebuildIndex removes an index and its catalog entry then builds it again
+// with BuildIndex. The new index has a reverse bucket and escaped keys even
+// if the old one didn't. Queries using the index will miss items until the
+// build is done.
+//
+// Index buckets are removed outside of any transaction, in batches on
+// Badger, so a failed rebuild may leave part of the old index. Running it
+// again removes the rest.
+func (db *DB) RebuildIndex(f DataFile, example store.Value, d *index.Definition, o *BuildOptions) error {
+	return rebuildIndex(
+		func() (engine.Engine, error) { return db.OpenDataFile(f) },
+		func(fn TxFunc) error { return db.Update(f, fn) },
+		example, d, o)
+}
+
+// TenantBuildIndex adds every item in the bucket of an example value in a
+// tenant data file to the index named by a definition, as for BuildIndex.
+func (db *DB) TenantBuildIndex(tenantID []byte, example store.Value, d *index.Definition, o *BuildOptions) error {
+	return buildIndex(func(fn TxFunc) error { return db.TenantWriter(tenantID, fn) }, example, d, o)
+}
+
+// TenantRebuildIndex removes an index from a tenant data file and builds it
+// again, as for RebuildIndex.
+func (db *DB) TenantRebuildIndex(tenantID []byte, example store.Value, d *index.Definition, o *BuildOptions) error {
+	return rebuildIndex(
+		func() (engine.Engine, error) {
+			file, _, err := db.leaseTenant(tenantID)
+			return file, err
+		},
+		func(fn TxFunc) error { return db.TenantWriter(tenantID, fn) },
+		example, d, o)
+}
+
+// MigrateIndexKeys rewrites the keys of every legacy non-unique index in a
+// data file so values containing any bytes match correctly. It returns the
+// number of index entries rewritten. Indexes are found as for
+// index.LegacyNonUnique, including those created before the catalog.
+func (db *DB) MigrateIndexKeys(f DataFile) (int, error) {
+	count := 0
+	err := db.Update(f, func(tx *Tx) error {
+		var err error
+		count, err = tx.migrateIndexKeys()
+		return err
+	})
+	return count, err
+}
+
+// TenantMigrateIndexKeys rewrites the keys of every legacy non-unique index
+// in a tenant data file, as for MigrateIndexKeys.
+func (db *DB) TenantMigrateIndexKeys(tenantID []byte) (int, error) {
+	count := 0
+	err := db.TenantWriter(tenantID, func(tx *Tx) error {
+		var err error
+		count, err = tx.migrateIndexKeys()
+		return err
+	})
+	return count, err
+}
+
+// migrateIndexKeys rewrites the keys of each legacy non-unique index.
+func (tx *Tx) migrateIndexKeys() (int, error) {
+	names, err := index.LegacyNonUnique(tx.tx)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+
+	for _, name := range names {
+		n, err := index.MigrateNonUnique(tx.tx, name)
+		if err != nil {
+			return count, err
+		}
+		count += n
+	}
+	return count, nil
+}
+
+// rebuildIndex removes an index then builds it again in batches. The index
+// buckets are deleted by the engine first, since one transaction may not be
+// able to delete them, then whatever writers have added since is removed in
+// one transaction with the catalog entry.
+func rebuildIndex(open func() (engine.Engine, error), update func(TxFunc) error, example store.Value, d *index.Definition, o *BuildOptions) error {
+	file, err := open()
+	if err != nil {
+		return err
+	}
+	err = deleteBuckets(file, d.BucketName, index.ReverseName(d.BucketName))
+	if err != nil {
+		return err
+	}
+	err = update(func(tx *Tx) error {
+		if err := index.Drop(tx.tx, d.BucketName); err != nil {
+			return err
+		}
+		return index.Unregister(tx.tx, d.BucketName)
+	})
+	if err != nil {
+		return err
+	}
+	return buildIndex(update, example, d, o)
+}
+
+// deleteBuckets removes buckets from a data file, each in transactions of its
+// own, then closes the file.
+func deleteBuckets(file engine.Engine, names ...[]byte) error {
+	defer file.Close()
+
+	for _, name := range names {
+		if err := file.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildIndex indexes the items in the bucket of an example value in batches,
+// each within a transaction started by update.
+func buildIndex(update func(TxFunc) error, example store.Value, d *index.Definition, o *BuildOptions) error {
+	if o == nil {
+		o = &BuildOptions{}
+	}
+	size := o.BatchSize
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+	var (
+		after    []byte
+		progress BuildProgress
+	)
+	for !progress.Done {
+		var (
+			last  []byte
+			batch BuildProgress
+		)
+		// after only moves once the batch is committed since update may
+		// execute the function again
+		err := update(func(tx *Tx) error {
+			var err error
+			last, batch, err = tx.indexBatch(example, d, after, size)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		after = last
+		progress.Scanned += batch.Scanned
+		progress.Indexed += batch.Indexed
+		progress.Done = batch.Done
+
+		if o.Progress != nil {
+			o.Progress(progress)
+		}
+	}
+	return nil
+}
+
+// indexBatch adds up to size items following the after key to the index
+// named by a definition. It returns the last key scanned and the progress of
+// the batch alone.
+func (tx *Tx) indexBatch(example store.Value, d *index.Definition, after []byte, size int) ([]byte, BuildProgress, error) {
+	var batch BuildProgress
+
+	name := example.BucketName()
+	if err := index.Register(tx.tx, name, d); err != nil {
+		return nil, batch, err
+	}
+	bucket := tx.tx.Bucket(name)
+	if bucket == nil {
+		batch.Done = true
+		return nil, batch, nil
+	}
+	c := tx.codecFor(example)
+	if err := checkCodec(tx.tx, name, c, false); err != nil {
+		return nil, batch, err
+	}
+	idx, err := makeIndex(tx.tx, d.BucketName, d.Unique)
+	if err != nil {
+		return nil, batch, err
+	}
+	cursor := bucket.Cursor()
+	k, data := cursor.First()
+
+	if after != nil {
+		k, data = cursor.Seek(after)
+		if bytes.Equal(k, after) {
+			k, data = cursor.Next()
+		}
+	}
+	for ; k != nil && batch.Scanned < size; k, data = cursor.Next() {
+		// cursor keys are only valid until the cursor moves
+		after = append([]byte(nil), k...)
+		batch.Scanned++
+
+		item := newValue(example)
+		if err := c.Unmarshal(data, item); err != nil {
+			return nil, batch, err
+		}
+		for _, def := range item.IndexMap().Definitions {
+			if !bytes.Equal(def.BucketName, d.BucketName) || len(def.Value) == 0 {
+				continue
+			}
+			if def.Unique != d.Unique {
+				return nil, batch, ErrIndexMismatch
+			}
+			if err := idx.Add(def.Value, after); err != nil {
+				return nil, batch, err
+			}
+			batch.Indexed++
+			break
+		}
+	}
+	batch.Done = k == nil
+	return after, batch, nil
+}
@@ -0,0 +1,231 @@
+package pbdb_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	db "github.com/toba/pbdb"
+	"github.com/toba/pbdb/engine"
+	"github.com/toba/pbdb/index"
+	"github.com/toba/pbdb/key"
+)
+
+type (
+	// TestPlace is stored before its city is indexed.
+	TestPlace struct {
+		Name string
+		City string
+	}
+
+	// TestIndexedPlace reads the same bucket as TestPlace with an index on
+	// the city.
+	TestIndexedPlace struct {
+		Name string
+		City string
+	}
+)
+
+var (
+	placeBucket = []byte("TestPlace")
+	cityIndex   = index.Name("TestCity")
+)
+
+func (t *TestPlace) BucketName() []byte  { return placeBucket }
+func (t *TestPlace) IndexMap() index.Map { return index.Map{} }
+
+func (t *TestIndexedPlace) BucketName() []byte { return placeBucket }
+func (t *TestIndexedPlace) IndexMap() index.Map {
+	return index.Define([]byte(t.City), cityIndex, false)
+}
+
+func TestBuildIndex(t *testing.T) {
+	withDatabase(t, func(t *testing.T, d *db.DB) {
+		for _, city := range []string{"Paris", "Rome", "Paris", "Oslo", "Paris"} {
+			_, err := d.SystemAdd(&TestPlace{Name: "place", City: city})
+			assert.NoError(t, err)
+		}
+		example := &TestIndexedPlace{City: "Paris"}
+		def := &index.Definition{BucketName: cityIndex}
+
+		matches, err := d.Query(db.SystemFile, example)
+		assert.NoError(t, err)
+		assert.Empty(t, matches)
+
+		var reports []db.BuildProgress
+
+		err = d.BuildIndex(db.SystemFile, example, def, &db.BuildOptions{
+			BatchSize: 2,
+			Progress: func(p db.BuildProgress) {
+				if len(reports) == 0 {
+					// writers may add items between batches
+					_, err := d.SystemAdd(&TestIndexedPlace{Name: "new", City: "Paris"})
+					assert.NoError(t, err)
+				}
+				reports = append(reports, p)
+			},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []db.BuildProgress{
+			{Scanned: 2, Indexed: 2},
+			{Scanned: 4, Indexed: 4},
+			{Scanned: 6, Indexed: 6, Done: true},
+		}, reports)
+
+		matches, err = d.Query(db.SystemFile, example)
+		assert.NoError(t, err)
+		assert.Len(t, matches, 4)
+
+		list, err := d.Indexes(db.SystemFile, placeBucket)
+		assert.NoError(t, err)
+		assert.Len(t, list, 1)
+		assert.Equal(t, cityIndex, list[0].Name)
+	})
+}
+
+func TestRebuildIndex(t *testing.T) {
+	withDatabase(t, func(t *testing.T, d *db.DB) {
+		for _, city := range []string{"Paris", "Rome"} {
+			_, err := d.SystemAdd(&TestIndexedPlace{Name: "place", City: city})
+			assert.NoError(t, err)
+		}
+		// lose the index entries
+		cn, err := d.OpenDataFile(db.SystemFile)
+		assert.NoError(t, err)
+		err = cn.Update(func(tx engine.Tx) error {
+			return index.GetNonUnique(tx, cityIndex).RemoveValue([]byte("Paris"))
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, cn.Close())
+
+		example := &TestIndexedPlace{City: "Paris"}
+		matches, err := d.Query(db.SystemFile, example)
+		assert.NoError(t, err)
+		assert.Empty(t, matches)
+
+		var last db.BuildProgress
+
+		err = d.RebuildIndex(db.SystemFile, example, &index.Definition{BucketName: cityIndex}, &db.BuildOptions{
+			Progress: func(p db.BuildProgress) { last = p },
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, db.BuildProgress{Scanned: 2, Indexed: 2, Done: true}, last)
+
+		matches, err = d.Query(db.SystemFile, example)
+		assert.NoError(t, err)
+		assert.Len(t, matches, 1)
+	})
+}
+
+func TestMigrateIndexKeys(t *testing.T) {
+	withDatabase(t, func(t *testing.T, d *db.DB) {
+		// a data file written before the catalog and escaped keys
+		cn, err := d.OpenDataFile(db.SystemFile)
+		assert.NoError(t, err)
+		err = cn.Update(func(tx engine.Tx) error {
+			items, err := tx.CreateBucketIfNotExists(placeBucket)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucketIfNotExists(cityIndex); err != nil {
+				return err
+			}
+			cities, err := index.MakeNonUnique(tx, cityIndex)
+			if err != nil {
+				return err
+			}
+			for _, city := range []string{"Paris", "Rome", "Paris"} {
+				k, err := key.Create()
+				if err != nil {
+					return err
+				}
+				data, err := db.Encode(&TestIndexedPlace{Name: "place", City: city})
+				if err != nil {
+					return err
+				}
+				if err := items.Put(k, data); err != nil {
+					return err
+				}
+				if err := cities.Add([]byte(city), k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, cn.Close())
+
+		list, err := d.Indexes(db.SystemFile, placeBucket)
+		assert.NoError(t, err)
+		assert.Empty(t, list)
+
+		count, err := d.MigrateIndexKeys(db.SystemFile)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, count)
+
+		matches, err := d.Query(db.SystemFile, &TestIndexedPlace{City: "Paris"})
+		assert.NoError(t, err)
+		assert.Len(t, matches, 2)
+
+		count, err = d.MigrateIndexKeys(db.SystemFile)
+		assert.NoError(t, err)
+		assert.Zero(t, count)
+	})
+}
+
+func TestBuildIndexConcurrently(t *testing.T) {
+	withBadger(t, func(d *db.DB) {
+		const total = 200
+		var first []byte
+
+		for i := 0; i < total; i++ {
+			k, err := d.SystemAdd(&TestPlace{Name: "place", City: "Paris"})
+			assert.NoError(t, err)
+			if first == nil {
+				first = k
+			}
+		}
+		stop := repeatConcurrently(t, func() error {
+			return d.UpdateItem(db.SystemFile, first, &TestIndexedPlace{Name: "first", City: "Paris"})
+		})
+		var last db.BuildProgress
+
+		err := d.BuildIndex(db.SystemFile, &TestIndexedPlace{}, &index.Definition{BucketName: cityIndex}, &db.BuildOptions{
+			BatchSize: 5,
+			Progress:  func(p db.BuildProgress) { last = p },
+		})
+		stop()
+
+		assert.NoError(t, err)
+		assert.Equal(t, db.BuildProgress{Scanned: total, Indexed: total, Done: true}, last)
+
+		matches, err := d.Query(db.SystemFile, &TestIndexedPlace{City: "Paris"})
+		assert.NoError(t, err)
+		assert.Len(t, matches, total)
+	})
+}
+
+// repeatConcurrently executes a function repeatedly until the returned
+// function is called, so transactions reading what it writes conflict.
+func repeatConcurrently(t *testing.T, fn func() error) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				assert.NoError(t, fn())
+				time.Sleep(5 * time.Millisecond)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
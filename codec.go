@@ -1,38 +1,253 @@
-package db
+package pbdb
 
 import (
 	"bytes"
 	"encoding/binary"
 	"encoding/gob"
+	"encoding/json"
+	"sync"
 
-	"toba.io/lib/oops"
+	"github.com/golang/protobuf/proto"
+	"github.com/toba/pbdb/engine"
+	"github.com/toba/pbdb/store"
+	"github.com/vmihailenco/msgpack/v4"
 )
 
-// Encode converts a BoltValue to a gob byte array.
+type (
+	// Codec converts values to and from the bytes stored in a data file.
+	Codec interface {
+		Name() string
+		Marshal(v interface{}) ([]byte, error)
+		Unmarshal(data []byte, v interface{}) error
+	}
+
+	gobCodec      struct{}
+	protobufCodec struct{}
+	jsonCodec     struct{}
+	msgpackCodec  struct{}
+)
+
+var (
+	// Gob encodes plain Go structs.
+	// See https://golang.org/pkg/encoding/gob/
+	Gob Codec = gobCodec{}
+
+	// Protobuf encodes generated protocol buffer messages in the same wire
+	// format used by gRPC.
+	// See https://developers.google.com/protocol-buffers/docs/encoding
+	Protobuf Codec = protobufCodec{}
+
+	// JSON encodes values as JSON text.
+	// See https://golang.org/pkg/encoding/json/
+	JSON Codec = jsonCodec{}
+
+	// Msgpack encodes values as MessagePack.
+	// See https://msgpack.org/
+	Msgpack Codec = msgpackCodec{}
+
+	// codecs is the registry of codecs by name, used to read the codec
+	// recorded for a bucket.
+	codecs = struct {
+		sync.RWMutex
+		named map[string]Codec
+	}{named: make(map[string]Codec)}
+
+	// codecBucket maps item bucket names to the name of the codec that wrote
+	// them.
+	codecBucket = []byte("_codec_")
+)
+
+func init() {
+	for _, c := range []Codec{Gob, Protobuf, JSON, Msgpack} {
+		RegisterCodec(c)
+	}
+}
+
+// RegisterCodec adds a codec to the registry, replacing any codec with the
+// same name.
+func RegisterCodec(c Codec) {
+	codecs.Lock()
+	codecs.named[c.Name()] = c
+	codecs.Unlock()
+}
+
+// CodecNamed returns the registered codec with a name.
+func CodecNamed(name string) (Codec, error) {
+	codecs.RLock()
+	c, ok := codecs.named[name]
+	codecs.RUnlock()
+	if !ok {
+		return nil, ErrUnknownCodec
+	}
+	return c, nil
+}
+
+// CodecFor returns the default codec for a value: Protobuf for values
+// implementing proto.Message and Gob for anything else.
+func CodecFor(v interface{}) Codec {
+	if _, ok := v.(proto.Message); ok {
+		return Protobuf
+	}
+	return Gob
+}
+
+// Encode converts a value to bytes using its default codec.
 func Encode(value interface{}) ([]byte, error) {
+	return CodecFor(value).Marshal(value)
+}
+
+// Decode converts stored bytes to a value using its default codec.
+func Decode(data []byte, value interface{}) error {
+	return CodecFor(value).Unmarshal(data, value)
+}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
 	var buf bytes.Buffer
 	en := gob.NewEncoder(&buf)
-	err := en.Encode(value)
+	err := en.Encode(v)
 	if err != nil {
 		return nil, err
 	}
 	return buf.Bytes(), nil
 }
 
-// Decode converts Bolt stored gob value to a BoltValue interface.
-func Decode(data []byte, value interface{}) error {
-	var buf bytes.Buffer
-	decoder := gob.NewDecoder(&buf)
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
 
-	_, err := buf.Write(data)
-	if err != nil {
-		return err
+func (protobufCodec) Name() string { return "protobuf" }
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, ErrNotProtoMessage
+	}
+	return proto.Marshal(m)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return ErrNotProtoMessage
+	}
+	return proto.Unmarshal(data, m)
+}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (msgpackCodec) Name() string { return "msgpack" }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+// checkCodec returns ErrDifferentCodec if a bucket was written with a codec
+// other than c. If the bucket has no recorded codec and record is true then
+// c is recorded for it.
+func checkCodec(tx engine.Tx, bucketName []byte, c Codec, record bool) error {
+	var meta engine.Bucket
+	var err error
+
+	if record {
+		meta, err = tx.CreateBucketIfNotExists(codecBucket)
+		if err != nil {
+			return err
+		}
+	} else {
+		meta = tx.Bucket(codecBucket)
+	}
+	if meta == nil {
+		return nil
+	}
+	name := meta.Get(bucketName)
+
+	if name == nil {
+		if record {
+			return meta.Put(bucketName, []byte(c.Name()))
+		}
+		return nil
 	}
-	return decoder.Decode(value)
+	if string(name) != c.Name() {
+		return ErrDifferentCodec
+	}
+	return nil
+}
+
+// MigrateCodec re-encodes every item in the bucket of an example value with
+// a different codec and records the new codec for the bucket. Items are
+// read with the codec previously recorded for the bucket or, if there is
+// none, the codec configured for the data file.
+//
+// The data file should be configured with UseCodec to match before further
+// reads or writes.
+func (db *DB) MigrateCodec(f DataFile, example store.Value, to Codec) error {
+	if !db.ready {
+		return ErrNotInitialized
+	}
+	from := db.codecFor(f, example)
+
+	return db.withTransaction(db.path[f], true, func(tx engine.Tx) error {
+		bucket := tx.Bucket(example.BucketName())
+		if bucket == nil {
+			return nil
+		}
+		meta, err := tx.CreateBucketIfNotExists(codecBucket)
+		if err != nil {
+			return err
+		}
+		if name := meta.Get(example.BucketName()); name != nil {
+			if from, err = CodecNamed(string(name)); err != nil {
+				return err
+			}
+		}
+		if from.Name() == to.Name() {
+			return nil
+		}
+		items := make(map[string][]byte)
+
+		err = bucket.ForEach(func(k, data []byte) error {
+			v := newValue(example)
+			if err := from.Unmarshal(data, v); err != nil {
+				return err
+			}
+			converted, err := to.Marshal(v)
+			if err != nil {
+				return err
+			}
+			items[string(k)] = converted
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for k, data := range items {
+			if err := bucket.Put([]byte(k), data); err != nil {
+				return err
+			}
+		}
+		return meta.Put(example.BucketName(), []byte(to.Name()))
+	})
 }
 
-// NumberToBytes converts numbers into a byte slice for storage. The format is big endian
-// so that a sort of the slices matches the numeric order.
+// NumberToBytes converts numbers into a byte slice for storage. The format is
+// big endian so that a sort of the slices matches the numeric order of
+// non-negative numbers. Negative numbers sort after positive ones so index
+// values should be encoded with the order package instead.
 func NumberToBytes(v interface{}) ([]byte, error) {
 	var buf bytes.Buffer
 	var raw interface{}
@@ -45,7 +260,7 @@ func NumberToBytes(v interface{}) ([]byte, error) {
 	case int8, int16, int32, int64, uint8, uint16, uint32, uint64:
 		raw = v
 	default:
-		return nil, oops.NotNumeric
+		return nil, ErrNotNumeric
 	}
 
 	if raw == nil {
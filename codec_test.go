@@ -1,13 +1,39 @@
-package db_test
+package pbdb_test
 
 import (
+	"sync"
 	"testing"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/stretchr/testify/assert"
-	"github.com/toba/pbdb"
+	db "github.com/toba/pbdb"
+	"github.com/toba/pbdb/index"
 	"github.com/toba/pbdb/schema"
 )
 
+// ProtoPerson is written as protoc-gen-go would generate it for
+//
+//	message ProtoPerson {
+//	  string first_name = 1;
+//	  string last_name = 2;
+//	}
+type ProtoPerson struct {
+	FirstName string `protobuf:"bytes,1,opt,name=first_name,json=firstName,proto3" json:"first_name,omitempty"`
+	LastName  string `protobuf:"bytes,2,opt,name=last_name,json=lastName,proto3" json:"last_name,omitempty"`
+}
+
+func (m *ProtoPerson) Reset()         { *m = ProtoPerson{} }
+func (m *ProtoPerson) String() string { return proto.CompactTextString(m) }
+func (*ProtoPerson) ProtoMessage()    {}
+
+// CodecItem is stored in its own bucket so tests can change its codec.
+type CodecItem struct {
+	Text string
+}
+
+func (c *CodecItem) BucketName() []byte  { return []byte("CodecItem") }
+func (c *CodecItem) IndexMap() index.Map { return index.Map{} }
+
 var (
 	signed = map[int][]byte{
 		-123456:            []byte{255, 255, 255, 255, 255, 254, 29, 192},
@@ -36,6 +62,104 @@ func TestEncodeDecode(t *testing.T) {
 	assert.Equal(t, firstName, out.FirstName)
 }
 
+func TestProtobufDefault(t *testing.T) {
+	person := &ProtoPerson{FirstName: firstName, LastName: lastName}
+	assert.Equal(t, db.Protobuf, db.CodecFor(person))
+	assert.Equal(t, db.Gob, db.CodecFor(employee.Value))
+
+	buf, err := db.Encode(person)
+	assert.NoError(t, err)
+
+	// storage should match the gRPC wire format
+	wire, err := proto.Marshal(person)
+	assert.NoError(t, err)
+	assert.Equal(t, wire, buf)
+
+	out := &ProtoPerson{}
+	err = db.Decode(buf, out)
+	assert.NoError(t, err)
+	assert.Equal(t, person, out)
+
+	_, err = db.Protobuf.Marshal(employee.Value)
+	assert.Equal(t, db.ErrNotProtoMessage, err)
+}
+
+func TestCodecRegistry(t *testing.T) {
+	for _, name := range []string{"gob", "protobuf", "json", "msgpack"} {
+		c, err := db.CodecNamed(name)
+		assert.NoError(t, err)
+		assert.Equal(t, name, c.Name())
+	}
+	_, err := db.CodecNamed("nothing")
+	assert.Equal(t, db.ErrUnknownCodec, err)
+}
+
+func TestCodecs(t *testing.T) {
+	for _, c := range []db.Codec{db.Gob, db.JSON, db.Msgpack} {
+		buf, err := c.Marshal(employee.Value)
+		assert.NoError(t, err)
+
+		out := &schema.Employee{}
+		err = c.Unmarshal(buf, out)
+		assert.NoError(t, err, c.Name())
+		assert.Equal(t, employee.Value, out, c.Name())
+	}
+}
+
+func TestDifferentCodec(t *testing.T) {
+	item := &CodecItem{Text: "text"}
+	_, err := db.SystemAdd(item)
+	assert.NoError(t, err)
+
+	db.UseCodec(db.SystemFile, db.JSON)
+	defer db.UseCodec(db.SystemFile, nil)
+
+	// bucket was written with gob
+	_, err = db.SystemAdd(item)
+	assert.Equal(t, db.ErrDifferentCodec, err)
+	_, err = db.SystemHas(item)
+	assert.Equal(t, db.ErrDifferentCodec, err)
+
+	err = db.MigrateCodec(db.SystemFile, item, db.JSON)
+	assert.NoError(t, err)
+
+	exists, err := db.SystemHas(item)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	db.UseCodec(db.SystemFile, nil)
+	_, err = db.SystemHas(item)
+	assert.Equal(t, db.ErrDifferentCodec, err)
+}
+
+// TestUseCodecConcurrently changes codecs while transactions read them. Run
+// it with the race detector to find unguarded access.
+func TestUseCodecConcurrently(t *testing.T) {
+	withDatabase(t, func(t *testing.T, d *db.DB) {
+		var wg sync.WaitGroup
+
+		for i := 0; i < 4; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					d.UseCodec(db.LogFile, db.JSON)
+					d.UseCodec(db.LogFile, nil)
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					// the codec is chosen before the missing bucket is found
+					_, err := d.Query(db.SystemFile, &CodecItem{})
+					assert.NoError(t, err)
+				}
+			}()
+		}
+		wg.Wait()
+	})
+}
+
 func TestNumberToBytes(t *testing.T) {
 	for num, expect := range signed {
 		buf, err := db.NumberToBytes(num)
@@ -1,220 +1,585 @@
 package pbdb
 
 import (
-	"github.com/boltdb/bolt"
+	"bytes"
+	"errors"
+	"reflect"
+
+	"github.com/toba/pbdb/engine"
 	"github.com/toba/pbdb/index"
 	"github.com/toba/pbdb/key"
+	"github.com/toba/pbdb/query"
 	"github.com/toba/pbdb/store"
 )
 
-type (
-	bucketCallback func(*bolt.Bucket) error
-	txCallback     func(*bolt.Tx) error
-)
+type txCallback func(engine.Tx) error
+
+// errStop ends bucket iteration early without reporting an error.
+var errStop = errors.New("stop iteration")
 
 // SystemHas indicates whether the system data file contains a value.
-func SystemHas(v store.Value) (bool, error) {
-	return Has(SystemFile, v)
+func (db *DB) SystemHas(v store.Value) (bool, error) {
+	return db.Has(SystemFile, v)
 }
 
-func SystemHasKey(bucketName, key []byte) (bool, error) {
-	return HasKey(SystemFile, bucketName, key)
+// SystemHasKey indicates whether a bucket in the system data file contains a
+// key.
+func (db *DB) SystemHasKey(bucketName, key []byte) (bool, error) {
+	return db.HasKey(SystemFile, bucketName, key)
 }
 
 // SystemAdd adds a value to the system data file.
-func SystemAdd(v store.Value) ([]byte, error) {
-	return Add(SystemFile, v)
+func (db *DB) SystemAdd(v store.Value) ([]byte, error) {
+	return db.Add(SystemFile, v)
 }
 
 // TenantHas indicates whether a tenant data file contains a value.
-func TenantHas(tenantID []byte, v store.Value) (bool, error) {
-	if !Ready {
-		return false, ErrNotInitialized
+func (db *DB) TenantHas(tenantID []byte, v store.Value) (bool, error) {
+	exists := false
+
+	err := db.TenantReader(tenantID, func(tx *Tx) error {
+		var err error
+		exists, err = tx.Has(v)
+		return err
+	})
+	return exists, err
+}
+
+// TenantHasKey indicates whether a bucket in a tenant data file contains a
+// key.
+func (db *DB) TenantHasKey(tenantID, bucketName, key []byte) (bool, error) {
+	exists := false
+
+	err := db.TenantReader(tenantID, func(tx *Tx) error {
+		var err error
+		exists, err = tx.HasKey(bucketName, key)
+		return err
+	})
+	return exists, err
+}
+
+// TenantGet a value from a tenant data file based on an example value.
+func (db *DB) TenantGet(tenantID []byte, v store.Value) (store.Value, error) {
+	var out store.Value
+
+	err := db.TenantReader(tenantID, func(tx *Tx) error {
+		var err error
+		out, err = tx.Get(v)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-	if !key.IsValid(tenantID) {
-		return false, ErrInvalidTenant
+	return out, nil
+}
+
+// TenantQuery returns every item in a tenant data file matching an example
+// value.
+func (db *DB) TenantQuery(tenantID []byte, example store.Value) ([]store.Value, error) {
+	var values []store.Value
+
+	err := db.TenantReader(tenantID, func(tx *Tx) error {
+		var err error
+		values, err = tx.Query(example)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-	name := key.ToString(tenantID)
-	if !validFileName.MatchString(name) {
-		return false, ErrInvalidDataFileName
+	return values, nil
+}
+
+// TenantQueryRange returns the items in a tenant data file with values in a
+// range of an index.
+func (db *DB) TenantQueryRange(tenantID []byte, example store.Value, indexName, min, max []byte, opts *index.QueryOptions) ([]store.Value, error) {
+	var values []store.Value
+
+	err := db.TenantReader(tenantID, func(tx *Tx) error {
+		var err error
+		values, err = tx.QueryRange(example, indexName, min, max, opts)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
+	return values, nil
+}
 
-	err := readBucket(rootPath+name, v.BucketName(), func(b *bolt.Bucket) error {
-		return nil
+// TenantQueryPrefixRange returns the items in a tenant data file with values
+// in a range of an index following a prefix.
+func (db *DB) TenantQueryPrefixRange(tenantID []byte, example store.Value, indexName, prefix, min, max []byte, opts *index.QueryOptions) ([]store.Value, error) {
+	var values []store.Value
+
+	err := db.TenantReader(tenantID, func(tx *Tx) error {
+		var err error
+		values, err = tx.QueryPrefixRange(example, indexName, prefix, min, max, opts)
+		return err
 	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
 
+// TenantAdd adds a value and its indexes to a tenant data file.
+func (db *DB) TenantAdd(tenantID []byte, v store.Value) ([]byte, error) {
+	var k []byte
+
+	err := db.TenantWriter(tenantID, func(tx *Tx) error {
+		var err error
+		k, err = tx.Add(v)
+		return err
+	})
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	return false, nil
+	return k, nil
 }
 
-// Has indicates if data file has value.
-func Has(f DataFile, v store.Value) (bool, error) {
-	if !Ready {
-		return false, ErrNotInitialized
+// TenantUpdate replaces an existing value in a tenant data file along with
+// any of its index entries that changed. A value without an existing item is
+// added if the tenant quota allows it.
+func (db *DB) TenantUpdate(tenantID, k []byte, v store.Value) error {
+	return db.TenantWriter(tenantID, func(tx *Tx) error {
+		return tx.Update(k, v)
+	})
+}
+
+// TenantDelete removes the item at a key in a tenant data file along with
+// every index entry referencing it.
+func (db *DB) TenantDelete(tenantID, k []byte, v store.Value) error {
+	return db.TenantWriter(tenantID, func(tx *Tx) error {
+		return tx.Delete(k, v)
+	})
+}
+
+// TenantDeleteMatching removes all items in a tenant data file matching an
+// example value, and their index entries, returning the number of items
+// removed.
+func (db *DB) TenantDeleteMatching(tenantID []byte, example store.Value) (int, error) {
+	count := 0
+
+	err := db.TenantWriter(tenantID, func(tx *Tx) error {
+		var err error
+		count, err = tx.DeleteMatching(example)
+		return err
+	})
+	if err != nil {
+		return 0, err
 	}
-	err := readBucket(path[f], v.BucketName(), func(b *bolt.Bucket) error {
-		return nil
+	return count, nil
+}
+
+// TenantIndexes returns the catalog entries for the indexes of a bucket in a
+// tenant data file.
+func (db *DB) TenantIndexes(tenantID, bucketName []byte) ([]*index.Info, error) {
+	var list []*index.Info
+
+	err := db.TenantReader(tenantID, func(tx *Tx) error {
+		var err error
+		list, err = tx.Indexes(bucketName)
+		return err
 	})
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	return false, nil
+	return list, nil
+}
+
+// Has indicates if data file has value.
+func (db *DB) Has(f DataFile, v store.Value) (bool, error) {
+	exists := false
+
+	err := db.View(f, func(tx *Tx) error {
+		var err error
+		exists, err = tx.Has(v)
+		return err
+	})
+	return exists, err
 }
 
 // HasKey indicates if a bucket contains a key.
-func HasKey(f DataFile, bucketName, key []byte) (bool, error) {
-	if !Ready {
-		return false, ErrNotInitialized
-	}
+func (db *DB) HasKey(f DataFile, bucketName, key []byte) (bool, error) {
 	exists := false
-	err := readBucket(path[f], bucketName, func(b *bolt.Bucket) error {
-		value := b.Get(key)
-		if value != nil {
-			exists = true
-		}
-		return nil
+
+	err := db.View(f, func(tx *Tx) error {
+		var err error
+		exists, err = tx.HasKey(bucketName, key)
+		return err
 	})
 	return exists, err
 }
 
-// Get a value from the data file based on an example value. The store.Value
-// interface builds a lookup plan utilizing indexes as appropriate.
-func Get(f DataFile, v store.Value) (store.Value, error) {
-	if !Ready {
-		return nil, ErrNotInitialized
-	}
+// Get a value from the data file based on an example value. The example's
+// index map builds a lookup plan that is resolved through the named index
+// buckets and the first matching item is decoded into a new value of the
+// same type as the example.
+func (db *DB) Get(f DataFile, v store.Value) (store.Value, error) {
 	var out store.Value
 
-	err := readBucket(path[f], v.BucketName(), func(b *bolt.Bucket) error {
-		//plan := v.QueryPlan(v)
+	err := db.View(f, func(tx *Tx) error {
+		var err error
+		out, err = tx.Get(v)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
 
-		// if len(plan.Indexes) > 0 {
-		// 	idx := plan.Indexes[0]
-		// 	itemKey := getIndexedValue(b.Tx(), idx)
-		// 	if itemKey == nil {
-		// 		return nil
-		// 	}
-		// }
+// Query returns every item in a data file matching an example value.
+func (db *DB) Query(f DataFile, example store.Value) ([]store.Value, error) {
+	var values []store.Value
 
-		data := b.Get([]byte("item key"))
-		return Decode(data, out)
+	err := db.View(f, func(tx *Tx) error {
+		var err error
+		values, err = tx.Query(example)
+		return err
 	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// QueryRange returns the items in a data file with values in a range of an
+// index.
+func (db *DB) QueryRange(f DataFile, example store.Value, indexName, min, max []byte, opts *index.QueryOptions) ([]store.Value, error) {
+	var values []store.Value
 
+	err := db.View(f, func(tx *Tx) error {
+		var err error
+		values, err = tx.QueryRange(example, indexName, min, max, opts)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	return out, nil
+	return values, nil
+}
+
+// QueryPrefixRange returns the items in a data file with values in a range of
+// an index following a prefix.
+func (db *DB) QueryPrefixRange(f DataFile, example store.Value, indexName, prefix, min, max []byte, opts *index.QueryOptions) ([]store.Value, error) {
+	var values []store.Value
+
+	err := db.View(f, func(tx *Tx) error {
+		var err error
+		values, err = tx.QueryPrefixRange(example, indexName, prefix, min, max, opts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
 }
 
 // Add a value and its indexes to a data file. The indexes are defined by the
 // store.Value interface.
-func Add(f DataFile, v store.Value) ([]byte, error) {
-	if !Ready {
-		return nil, ErrNotInitialized
-	}
-	k, err := key.Create()
+func (db *DB) Add(f DataFile, v store.Value) ([]byte, error) {
+	var k []byte
+
+	err := db.Update(f, func(tx *Tx) error {
+		var err error
+		k, err = tx.Add(v)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	return k, save(path[f], k, v)
+	return k, nil
 }
 
-// Update an existing value in a data file.
-func Update(f DataFile, k []byte, v store.Value) error {
-	return save(path[f], k, v)
+// UpdateItem replaces an existing value in a data file. Index entries for
+// values that changed since the item was last saved are replaced in the same
+// transaction.
+func (db *DB) UpdateItem(f DataFile, k []byte, v store.Value) error {
+	return db.Update(f, func(tx *Tx) error {
+		return tx.Update(k, v)
+	})
 }
 
-func readBucket(p string, name []byte, fn bucketCallback) error {
-	return getBucket(p, name, false, fn)
+// Delete removes the item at a key along with every index entry referencing
+// it. The value only identifies the bucket. There is no error if the item
+// doesn't exist.
+func (db *DB) Delete(f DataFile, k []byte, v store.Value) error {
+	return db.Update(f, func(tx *Tx) error {
+		return tx.Delete(k, v)
+	})
 }
 
-func writeBucket(p string, name []byte, fn bucketCallback) error {
-	return getBucket(p, name, true, fn)
-}
+// DeleteMatching removes all items matching an example value, and their
+// index entries, returning the number of items removed. Matches are found
+// through the example's indexes or, if it has no indexed values, by
+// comparison with every item in the bucket.
+func (db *DB) DeleteMatching(f DataFile, example store.Value) (int, error) {
+	count := 0
 
-func getBucketForItem(p string, v store.Value, writable bool, fn bucketCallback) error {
-	return getBucket(p, v.BucketName(), writable, fn)
+	err := db.Update(f, func(tx *Tx) error {
+		var err error
+		count, err = tx.DeleteMatching(example)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
 }
 
-// getBucket retrieves the bucket for a value type in the data file at a given
-// path. If the bucket should be writable then it will be created if it does
-// not already exist, otherwise an error is returned for a non-existent bucket.
-func getBucket(p string, name []byte, writable bool, fn bucketCallback) error {
-	return withTransaction(p, writable, func(tx *bolt.Tx) error {
-		var bucket *bolt.Bucket
+// Indexes returns the catalog entries for the indexes of a bucket in a data
+// file.
+func (db *DB) Indexes(f DataFile, bucketName []byte) ([]*index.Info, error) {
+	var list []*index.Info
+
+	err := db.View(f, func(tx *Tx) error {
 		var err error
+		list, err = tx.Indexes(bucketName)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// withTransaction creates a transaction and passes it to callback function.
+// The data file is leased for the duration of the transaction and stays open
+// for other transactions afterward. A writable transaction is committed if
+// the callback returns no error. On Badger the callback is executed again if
+// its transaction conflicts with another.
+func (db *DB) withTransaction(p string, writable bool, fn txCallback) error {
+	file, err := db.openPath(p)
+	if err != nil {
+		return err
+	}
+	return withLease(file, writable, fn)
+}
+
+// withLease executes a callback within a transaction on a leased data file,
+// as for withTransaction, then releases the lease.
+func withLease(file *Lease, writable bool, fn txCallback) error {
+	defer file.Close()
 
-		if writable {
-			bucket, err = tx.CreateBucketIfNotExists(name)
-			if err != nil {
-				return err
-			}
+	if writable {
+		return file.Update(fn)
+	}
+	return file.View(fn)
+}
+
+// matchingItemKeys returns the keys of items matching an example value using
+// its query plan or, if the plan has no indexes, by comparing the encoded
+// example to every item.
+func matchingItemKeys(tx engine.Tx, bucket engine.Bucket, c Codec, example store.Value) ([][]byte, error) {
+	plan := query.Example(example.BucketName(), example.IndexMap())
+	if len(plan.Indexes) > 0 {
+		return planItemKeys(tx, plan)
+	}
+	data, err := c.Marshal(example)
+	if err != nil {
+		return nil, err
+	}
+	var keys [][]byte
+
+	err = bucket.ForEach(func(k, item []byte) error {
+		if bytes.Equal(item, data) {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// planItemKeys returns the keys of items matched by every index in a plan.
+func planItemKeys(tx engine.Tx, plan *query.Plan) ([][]byte, error) {
+	var keys [][]byte
+
+	for i, use := range plan.Indexes {
+		matches, err := indexedItemKeys(tx, use)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			keys = matches
 		} else {
-			bucket = tx.Bucket(name)
+			keys = key.IntersectLists(keys, matches)
+		}
+		if keys == nil {
+			return nil, nil
 		}
+	}
+	return keys, nil
+}
 
-		if bucket == nil {
-			return ErrNoBucket
+// indexedItemKeys returns the keys of items indexed to a value. There is no
+// error if the index bucket doesn't exist.
+func indexedItemKeys(tx engine.Tx, use query.UseIndex) ([][]byte, error) {
+	if use.Unique {
+		idx := index.GetUnique(tx, use.IndexBucket)
+		if idx == nil {
+			return nil, nil
 		}
-		return fn(bucket)
-	})
+		if itemKey := idx.FirstWithValue(use.IndexKey); itemKey != nil {
+			return [][]byte{itemKey}, nil
+		}
+		return nil, nil
+	}
+	idx := index.GetNonUnique(tx, use.IndexBucket)
+	if idx == nil {
+		return nil, nil
+	}
+	return idx.AllWithValue(use.IndexKey, nil)
 }
 
-// withTransaction creates a transaction and passes it to callback function.
-func withTransaction(p string, writable bool, fn txCallback) error {
-	db, err := openPath(p)
+// newValue creates an empty value of the same type as an example so stored
+// data can be decoded into it.
+func newValue(example store.Value) store.Value {
+	t := reflect.TypeOf(example)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return reflect.New(t).Interface().(store.Value)
+}
+
+// decodeItems decodes the items at a list of keys into new values of the
+// same type as an example. Keys without an item are skipped.
+func decodeItems(bucket engine.Bucket, c Codec, example store.Value, keys [][]byte) ([]store.Value, error) {
+	var values []store.Value
+
+	for _, k := range keys {
+		data := bucket.Get(k)
+		if data == nil {
+			continue
+		}
+		v := newValue(example)
+		if err := c.Unmarshal(data, v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// save value and its indexes in a writable transaction. If an item
+// already exists at the key then only index entries that differ from it are
+// removed or added. Every index in the value's map is checked against or
+// added to the index catalog. It returns whether a new item was created and
+// the size of the encoded value.
+func save(tx engine.Tx, c Codec, key []byte, v store.Value) (bool, int, error) {
+	data, err := c.Marshal(v)
 	if err != nil {
-		return err
+		return false, 0, err
 	}
-	tx, err := db.Begin(writable)
+	bucket, err := tx.CreateBucketIfNotExists(v.BucketName())
 	if err != nil {
-		return err
+		return false, 0, err
 	}
-	defer db.Close()
+	if err := checkCodec(tx, v.BucketName(), c, true); err != nil {
+		return false, 0, err
+	}
+	indexes := v.IndexMap()
 
-	if writable {
-		defer tx.Rollback()
+	for _, d := range indexes.Definitions {
+		if err := index.Register(tx, v.BucketName(), d); err != nil {
+			return false, 0, err
+		}
 	}
-	err = fn(tx)
+	var previous index.Map
+	existing := bucket.Get(key)
 
-	if writable && err == nil {
-		return tx.Commit()
+	if existing != nil {
+		stored := newValue(v)
+		if err := c.Unmarshal(existing, stored); err != nil {
+			return false, 0, err
+		}
+		previous = stored.IndexMap()
 	}
-	return err
+	added, removed := previous.Diff(indexes)
+
+	// remove first so values can move between items in one update
+	err = removeIndexValues(key, removed, tx)
+	if err != nil {
+		return false, 0, err
+	}
+	err = bucket.Put(key, data)
+	if err != nil {
+		return false, 0, err
+	}
+	return existing == nil, len(data), saveIndexes(key, added, tx)
 }
 
-// func getIndexedValue(tx *bolt.Tx, idx query.UseIndex) []byte {
-// 	bucket := tx.Bucket(idx.IndexBucket)
-// 	if bucket == nil {
-// 		return nil
-// 	}
-// 	return bucket.Get(idx.IndexKey)
-// }
+// deleteItem removes an item and its index entries. The indexes are those of
+// the stored item or, if it can't be decoded, those of the example.
+func deleteItem(tx engine.Tx, bucket engine.Bucket, c Codec, k []byte, example store.Value) error {
+	data := bucket.Get(k)
+	if data == nil {
+		return nil
+	}
+	indexes := example.IndexMap()
+	stored := newValue(example)
 
-// save value in Bolt.
-// See https://github.com/boltdb/bolt
-func save(p string, key []byte, v store.Value) error {
-	data, err := Encode(v)
-	if err != nil {
+	if err := c.Unmarshal(data, stored); err == nil {
+		indexes = stored.IndexMap()
+	}
+	if err := bucket.Delete(k); err != nil {
 		return err
 	}
+	return removeIndexes(k, indexes, tx)
+}
 
-	return withTransaction(p, true, func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists(v.BucketName())
-		if err != nil {
+// removeIndexes removes an item key from every index in a map. Indexes that
+// don't exist are skipped.
+func removeIndexes(itemKey []byte, indexes index.Map, tx engine.Tx) error {
+	for _, d := range indexes.Definitions {
+		idx := existingIndex(tx, d)
+		if idx == nil {
+			continue
+		}
+		if err := idx.RemoveItem(itemKey); err != nil {
 			return err
 		}
-		err = bucket.Put(key, data)
-		if err != nil {
+	}
+	return nil
+}
+
+// removeIndexValues removes the entries for each value in a map that are
+// indexed to an item key. Entries indexed to other items are unaffected.
+func removeIndexValues(itemKey []byte, indexes index.Map, tx engine.Tx) error {
+	for _, d := range indexes.Definitions {
+		idx := existingIndex(tx, d)
+		if idx == nil || len(d.Value) == 0 {
+			continue
+		}
+		if err := idx.Remove(d.Value, itemKey); err != nil {
 			return err
 		}
-		return saveIndexes(key, v.IndexMap(), tx)
-	})
+	}
+	return nil
 }
 
-func saveIndexes(itemKey []byte, indexes index.Map, tx *bolt.Tx) error {
+// existingIndex returns the index for a definition or nil if the index
+// bucket doesn't exist.
+func existingIndex(tx engine.Tx, d *index.Definition) index.Index {
+	if d.Unique {
+		if idx := index.GetUnique(tx, d.BucketName); idx != nil {
+			return idx
+		}
+	} else if idx := index.GetNonUnique(tx, d.BucketName); idx != nil {
+		return idx
+	}
+	return nil
+}
+
+// makeIndex returns a unique or non-unique index, creating its bucket if
+// needed.
+func makeIndex(tx engine.Tx, name []byte, unique bool) (index.Index, error) {
+	if unique {
+		return index.MakeUnique(tx, name)
+	}
+	return index.MakeNonUnique(tx, name)
+}
+
+func saveIndexes(itemKey []byte, indexes index.Map, tx engine.Tx) error {
 	if indexes.Definitions == nil || len(indexes.Definitions) == 0 {
 		return nil
 	}
@@ -222,11 +587,7 @@ func saveIndexes(itemKey []byte, indexes index.Map, tx *bolt.Tx) error {
 	var err error
 
 	for _, d := range indexes.Definitions {
-		if d.Unique {
-			idx, err = index.MakeUnique(tx, d.BucketName)
-		} else {
-			idx, err = index.MakeNonUnique(tx, d.BucketName)
-		}
+		idx, err = makeIndex(tx, d.BucketName, d.Unique)
 		if err != nil {
 			break
 		}
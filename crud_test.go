@@ -1,21 +1,31 @@
-package db_test
+package pbdb_test
 
 import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
-	"github.com/toba/pbdb"
+	db "github.com/toba/pbdb"
 	"github.com/toba/pbdb/index"
-	"toba.io/lib/config"
+	"github.com/toba/pbdb/key"
+	"github.com/toba/pbdb/order"
+	"github.com/toba/pbdb/store"
 )
 
-type TestSchema struct {
-	Name      string
-	Subdomain string
-}
+type (
+	TestSchema struct {
+		Name      string
+		Subdomain string
+	}
+
+	// TestLog has no indexes so it can only be matched by comparison.
+	TestLog struct {
+		Message string
+	}
+)
 
 var (
 	bucketName = []byte("TestBucket")
@@ -27,8 +37,11 @@ func (t *TestSchema) IndexMap() index.Map {
 	return index.Define([]byte(t.Name), indexName, true)
 }
 
+func (t *TestLog) BucketName() []byte  { return []byte("TestLog") }
+func (t *TestLog) IndexMap() index.Map { return index.Map{} }
+
 func TestMain(m *testing.M) {
-	cfg := config.Database{
+	cfg := db.Options{
 		Path: "",
 		Name: "test.db",
 	}
@@ -59,3 +72,303 @@ func TestSystemHasKey(t *testing.T) {
 	assert.NoError(t, err)
 	assert.True(t, exists)
 }
+
+func TestGet(t *testing.T) {
+	schema := &TestSchema{Name: "GetName", Subdomain: "GetSubdomain"}
+	_, err := db.SystemAdd(schema)
+	assert.NoError(t, err)
+
+	v, err := db.Get(db.SystemFile, &TestSchema{Name: "GetName"})
+	assert.NoError(t, err)
+	assert.IsType(t, &TestSchema{}, v)
+	assert.Equal(t, schema.Subdomain, v.(*TestSchema).Subdomain)
+
+	_, err = db.Get(db.SystemFile, &TestSchema{Name: "NoName"})
+	assert.Equal(t, db.ErrNotFound, err)
+
+	// an example without indexed values can't be looked up
+	_, err = db.Get(db.SystemFile, &TestSchema{Subdomain: "GetSubdomain"})
+	assert.Equal(t, db.ErrNoIndex, err)
+}
+
+func TestSystemHas(t *testing.T) {
+	_, err := db.SystemAdd(&TestSchema{Name: "HasName", Subdomain: "HasSubdomain"})
+	assert.NoError(t, err)
+
+	exists, err := db.SystemHas(&TestSchema{Name: "HasName"})
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = db.SystemHas(&TestSchema{Name: "NoName"})
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	// values without a unique index are compared to every item
+	_, err = db.SystemAdd(&TestLog{Message: "logged"})
+	assert.NoError(t, err)
+
+	exists, err = db.SystemHas(&TestLog{Message: "logged"})
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = db.SystemHas(&TestLog{Message: "not logged"})
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestTenantHas(t *testing.T) {
+	_, err := db.TenantHas([]byte("invalid"), &TestSchema{})
+	assert.Equal(t, db.ErrInvalidTenant, err)
+
+	tenantID, err := key.Create()
+	assert.NoError(t, err)
+
+	exists, err := db.TenantHas(tenantID, &TestSchema{Name: "HasName"})
+	assert.Equal(t, db.ErrTenantNotFound, err)
+	assert.False(t, exists)
+
+	tenantID, err = db.CreateTenant()
+	assert.NoError(t, err)
+	defer db.DeleteTenant(tenantID)
+
+	// a new tenant has no buckets
+	exists, err = db.TenantHas(tenantID, &TestSchema{Name: "HasName"})
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestDelete(t *testing.T) {
+	k, err := db.SystemAdd(&TestSchema{Name: "DeleteName"})
+	assert.NoError(t, err)
+
+	err = db.Delete(db.SystemFile, k, &TestSchema{})
+	assert.NoError(t, err)
+
+	exists, err := db.SystemHasKey(bucketName, k)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	// unique index entry should also be removed
+	exists, err = db.SystemHas(&TestSchema{Name: "DeleteName"})
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	// deleting a non-existent item is okay
+	err = db.Delete(db.SystemFile, k, &TestSchema{})
+	assert.NoError(t, err)
+}
+
+func TestDeleteMatching(t *testing.T) {
+	_, err := db.SystemAdd(&TestSchema{Name: "MatchName"})
+	assert.NoError(t, err)
+
+	count, err := db.DeleteMatching(db.SystemFile, &TestSchema{Name: "MatchName"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	_, err = db.Get(db.SystemFile, &TestSchema{Name: "MatchName"})
+	assert.Equal(t, db.ErrNotFound, err)
+
+	// values without indexes are matched by comparison
+	for i := 0; i < 2; i++ {
+		_, err = db.SystemAdd(&TestLog{Message: "delete me"})
+		assert.NoError(t, err)
+	}
+	count, err = db.DeleteMatching(db.SystemFile, &TestLog{Message: "delete me"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func TestUpdate(t *testing.T) {
+	k, err := db.SystemAdd(&TestSchema{Name: "OldName", Subdomain: "Subdomain"})
+	assert.NoError(t, err)
+
+	err = db.UpdateItem(db.SystemFile, k, &TestSchema{Name: "NewName", Subdomain: "Subdomain"})
+	assert.NoError(t, err)
+
+	// old unique index entry should be replaced
+	exists, err := db.SystemHas(&TestSchema{Name: "OldName"})
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	v, err := db.Get(db.SystemFile, &TestSchema{Name: "NewName"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Subdomain", v.(*TestSchema).Subdomain)
+
+	// updating without changing the indexed value is okay
+	err = db.UpdateItem(db.SystemFile, k, &TestSchema{Name: "NewName", Subdomain: "Other"})
+	assert.NoError(t, err)
+
+	// the old value is free for another item
+	_, err = db.SystemAdd(&TestSchema{Name: "OldName"})
+	assert.NoError(t, err)
+}
+
+func TestTenantCRUD(t *testing.T) {
+	tenantID, err := db.CreateTenant()
+	assert.NoError(t, err)
+	defer db.DeleteTenant(tenantID)
+
+	_, err = db.TenantAdd([]byte("invalid"), &TestSchema{})
+	assert.Equal(t, db.ErrInvalidTenant, err)
+
+	k, err := db.TenantAdd(tenantID, &TestSchema{Name: "TenantName", Subdomain: "Tenant"})
+	assert.NoError(t, err)
+
+	exists, err := db.TenantHasKey(tenantID, bucketName, k)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	// tenant data is separate from system data
+	_, err = db.SystemAdd(&TestSchema{Name: "SystemName"})
+	assert.NoError(t, err)
+	exists, err = db.SystemHas(&TestSchema{Name: "TenantName"})
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	exists, err = db.TenantHas(tenantID, &TestSchema{Name: "SystemName"})
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	v, err := db.TenantGet(tenantID, &TestSchema{Name: "TenantName"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Tenant", v.(*TestSchema).Subdomain)
+
+	err = db.TenantUpdate(tenantID, k, &TestSchema{Name: "TenantRenamed", Subdomain: "Tenant"})
+	assert.NoError(t, err)
+
+	exists, err = db.TenantHas(tenantID, &TestSchema{Name: "TenantName"})
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	for i := 0; i < 2; i++ {
+		_, err = db.TenantAdd(tenantID, &TestLog{Message: "tenant log"})
+		assert.NoError(t, err)
+	}
+	matches, err := db.TenantQuery(tenantID, &TestLog{Message: "tenant log"})
+	assert.NoError(t, err)
+	assert.Len(t, matches, 2)
+
+	count, err := db.TenantDeleteMatching(tenantID, &TestLog{Message: "tenant log"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	err = db.TenantDelete(tenantID, k, &TestSchema{})
+	assert.NoError(t, err)
+
+	_, err = db.TenantGet(tenantID, &TestSchema{Name: "TenantRenamed"})
+	assert.Equal(t, db.ErrNotFound, err)
+}
+
+// TestStaff indexes numbers and times with order preserving encodings.
+type TestStaff struct {
+	Name   string
+	Salary int64
+	Hired  time.Time
+}
+
+var (
+	salaryIndex = index.Name("TestSalary")
+	hiredIndex  = index.Name("TestHired")
+)
+
+func (t *TestStaff) BucketName() []byte { return []byte("TestStaff") }
+func (t *TestStaff) IndexMap() index.Map {
+	return index.Define(order.Int(t.Salary), salaryIndex, false).
+		Add(order.Time(t.Hired), hiredIndex, false)
+}
+
+func TestQueryRange(t *testing.T) {
+	withDatabase(t, func(t *testing.T, d *db.DB) {
+		staff := []*TestStaff{
+			{Name: "Ann", Salary: 52000, Hired: time.Date(2015, time.June, 1, 0, 0, 0, 0, time.UTC)},
+			{Name: "Bob", Salary: -100, Hired: time.Date(1999, time.January, 4, 0, 0, 0, 0, time.UTC)},
+			{Name: "Cal", Salary: 9000, Hired: time.Date(2018, time.March, 9, 0, 0, 0, 0, time.UTC)},
+			{Name: "Dee", Salary: 120000, Hired: time.Date(2016, time.July, 2, 0, 0, 0, 0, time.UTC)},
+		}
+		for _, s := range staff {
+			_, err := d.SystemAdd(s)
+			assert.NoError(t, err)
+		}
+		names := func(values []store.Value) []string {
+			var list []string
+			for _, v := range values {
+				list = append(list, v.(*TestStaff).Name)
+			}
+			return list
+		}
+
+		// negative salaries sort before positive ones
+		matches, err := d.QueryRange(db.SystemFile, &TestStaff{}, salaryIndex, order.Int(-1000), order.Int(60000), nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"Bob", "Cal", "Ann"}, names(matches))
+
+		// nil leaves either end of the range open
+		matches, err = d.QueryRange(db.SystemFile, &TestStaff{}, salaryIndex, nil, nil, &index.QueryOptions{Limit: 2, Reverse: true})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"Dee", "Ann"}, names(matches))
+
+		matches, err = d.QueryRange(db.SystemFile, &TestStaff{}, salaryIndex, order.Int(9000), nil, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"Cal", "Ann", "Dee"}, names(matches))
+
+		from := time.Date(2015, time.January, 1, 0, 0, 0, 0, time.UTC)
+		matches, err = d.QueryRange(db.SystemFile, &TestStaff{}, hiredIndex, order.Time(from), order.Time(from.AddDate(2, 0, 0)), nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"Ann", "Dee"}, names(matches))
+
+		matches, err = d.QueryRange(db.SystemFile, &TestStaff{}, index.Name("TestMissing"), order.Int(0), order.Int(1), nil)
+		assert.NoError(t, err)
+		assert.Empty(t, matches)
+	})
+}
+
+// TestContact has a composite index on last and first name.
+type TestContact struct {
+	FirstName string
+	LastName  string
+}
+
+var fullNameIndex = index.Name("TestFullName")
+
+func (t *TestContact) BucketName() []byte { return []byte("TestContact") }
+func (t *TestContact) IndexMap() index.Map {
+	return index.DefineComposite(fullNameIndex, false, order.String(t.LastName), order.String(t.FirstName))
+}
+
+func TestQueryPrefixRange(t *testing.T) {
+	withDatabase(t, func(t *testing.T, d *db.DB) {
+		contacts := []*TestContact{
+			{FirstName: "Jane", LastName: "Doe"},
+			{FirstName: "Adam", LastName: "Doer"},
+			{FirstName: "John", LastName: "Doe"},
+			{FirstName: "Jill", LastName: "Roe"},
+			{FirstName: "Abe", LastName: "Doe"},
+		}
+		for _, c := range contacts {
+			_, err := d.SystemAdd(c)
+			assert.NoError(t, err)
+		}
+		names := func(values []store.Value) []string {
+			var list []string
+			for _, v := range values {
+				c := v.(*TestContact)
+				list = append(list, c.FirstName+" "+c.LastName)
+			}
+			return list
+		}
+		doe := order.String("Doe")
+
+		matches, err := d.QueryPrefixRange(db.SystemFile, &TestContact{}, fullNameIndex, doe, nil, nil, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"Abe Doe", "Jane Doe", "John Doe"}, names(matches))
+
+		matches, err = d.QueryPrefixRange(db.SystemFile, &TestContact{}, fullNameIndex, doe, order.String("B"), order.String("Jo"), nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"Jane Doe"}, names(matches))
+
+		// the complete value still matches exactly
+		matches, err = d.Query(db.SystemFile, &TestContact{FirstName: "John", LastName: "Doe"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"John Doe"}, names(matches))
+	})
+}
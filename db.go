@@ -1,24 +1,66 @@
-// Package db creates and verifies BoltDB database files.
+// Package pbdb creates and verifies database files.
 package pbdb
 
 import (
-	"toba.io/lib/config"
-
 	"os"
+	"sync"
 
 	"strings"
 
 	"regexp"
 
-	"github.com/boltdb/bolt"
+	"github.com/toba/pbdb/engine"
 )
 
-type DataFile int
+type (
+	DataFile int
+
+	// Options configure a database opened with Open or Initialize.
+	Options struct {
+		// Path is the root directory for storing database files. An empty
+		// path means the current directory.
+		Path string
+		// Name is the file name of the SystemFile within Path.
+		Name string
+		// Storage is the engine used to open data files.
+		Storage engine.Kind
+		// MaxOpenFiles limits the number of data files kept open. Idle files
+		// are closed, least recently used first, and reopened on demand.
+		// Zero means no limit.
+		MaxOpenFiles int
+		// Quota limits the storage of tenants without a quota chosen by
+		// SetTenantQuota.
+		Quota Quota
+	}
+
+	// DB is a database of data files within a root directory. Each DB owns
+	// its open files so several may be used independently in one process.
+	DB struct {
+		// root is the directory for storing database files, always ending
+		// with a path separator unless empty.
+		root  string
+		path  map[DataFile]string
+		ready bool
+		files *OpenFiles
+		// codecs are codecs chosen for specific data files. They may be
+		// changed while transactions read them.
+		codecs struct {
+			sync.RWMutex
+			byFile map[DataFile]Codec
+		}
+		// quota is the default tenant quota.
+		quota Quota
+		// tenants is held while a tenant data file is found and leased, and
+		// exclusively while one is removed or renamed, so transactions
+		// never create the file of a missing tenant.
+		tenants sync.RWMutex
+	}
+)
 
 const (
 	// SystemFile is the path to the data file storing values common to all
 	// tenants, such as statistics and licenses. By default it is the
-	// root path plus configuration.Database.Name.
+	// root path plus Options.Name.
 	SystemFile DataFile = iota
 	// LogFile is the path to the data file that records common application
 	// activity. By default it is the root path plus logs.db.
@@ -26,81 +68,162 @@ const (
 )
 
 var (
-	// rootPath is the root directory for storing database files. It is
-	// usually specified by configuration.Database.Path.
-	rootPath string
-	path     map[DataFile]string
-
-	// Ready indicates database files have been created and write access
-	// validated.
-	Ready = false
 	slash = string(os.PathSeparator)
 
 	validFileName = regexp.MustCompile(`^[a-zA-Z0-9]{3,}$`)
-
-	dataFiles = OpenFiles{files: make(map[string]*bolt.DB)}
 )
 
-// Open returns connection to specific data file.
-func Open(f DataFile) (*bolt.DB, error) {
-	if !Ready {
-		return nil, ErrNotInitialized
+// Open creates the root directory and system data file described by options
+// and returns a database using them.
+func Open(o Options) (*DB, error) {
+	db := newDB()
+	if err := db.open(o); err != nil {
+		return nil, err
 	}
-	return dataFiles.Connect(path[f])
+	return db, nil
 }
 
-// OpenFile returns a connection to the named file within the root path.
-func OpenFile(name string) (*bolt.DB, error) {
-	if !Ready {
-		return nil, ErrNotInitialized
-	}
-	if !validFileName.MatchString(name) {
-		return nil, ErrInvalidDataFileName
+// newDB returns a database that must be opened before use.
+func newDB() *DB {
+	db := &DB{
+		path:  make(map[DataFile]string),
+		files: NewOpenFiles(engine.Bolt),
 	}
-	return dataFiles.Connect(rootPath + name)
+	db.codecs.byFile = make(map[DataFile]Codec)
+	return db
+}
+
+// Initialize database directory and files for the default database used by
+// package functions. Operations will use the validated paths until
+// re-initialized.
+func Initialize(o Options) error {
+	return std.open(o)
 }
 
-// Initialize database directory and files. Operations will use the
-// validated paths until re-initialized.
-func Initialize(config config.Database) error {
-	Reset()
-	rootPath = config.Path
+// open validates the database directory and files. Operations will use the
+// validated paths until the database is re-opened or reset.
+func (db *DB) open(o Options) error {
+	db.Reset()
+	db.root = o.Path
+	db.files.Kind = o.Storage
+	db.files.Limit = o.MaxOpenFiles
+	db.quota = o.Quota
 
-	if rootPath != "" {
+	if db.root != "" {
 		// empty path means current directory
-		if !strings.HasSuffix(rootPath, slash) {
-			rootPath += slash
+		if !strings.HasSuffix(db.root, slash) {
+			db.root += slash
 		}
-		_, err := os.Stat(rootPath)
+		_, err := os.Stat(db.root)
 
 		if err != nil && os.IsNotExist(err) {
 			// create path if it doesn't exist
-			err = os.Mkdir(rootPath, 0700)
+			err = os.Mkdir(db.root, 0700)
 			if err != nil {
 				return err
 			}
 		}
 	}
 
-	path[SystemFile] = rootPath + config.Name
-	path[LogFile] = rootPath + "logs.db"
+	db.path[SystemFile] = db.root + o.Name
+	db.path[LogFile] = db.root + "logs.db"
 
 	// ensure database file can be opened
-	_, err := dataFiles.Connect(path[SystemFile])
-	if err == nil {
-		Ready = true
+	l, err := db.files.Connect(db.path[SystemFile])
+	if err != nil {
+		return err
 	}
-	return err
+	db.ready = true
+	return l.Close()
+}
+
+// Ready indicates database files have been created and write access
+// validated.
+func (db *DB) Ready() bool {
+	return db.ready
+}
+
+// OpenDataFile returns connection to specific data file. Closing the
+// connection releases it without closing the file for other users.
+func (db *DB) OpenDataFile(f DataFile) (engine.Engine, error) {
+	if !db.ready {
+		return nil, ErrNotInitialized
+	}
+	return db.connect(db.path[f])
+}
+
+// OpenFile returns a connection to the named file within the root path.
+// Closing the connection releases it without closing the file for other
+// users.
+func (db *DB) OpenFile(name string) (engine.Engine, error) {
+	if !db.ready {
+		return nil, ErrNotInitialized
+	}
+	if !validFileName.MatchString(name) {
+		return nil, ErrInvalidDataFileName
+	}
+	return db.connect(db.root + name)
+}
+
+// connect returns a lease on the data file at a path as an engine so the
+// lease is released when the engine is closed.
+func (db *DB) connect(p string) (engine.Engine, error) {
+	l, err := db.files.Connect(p)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// FileStats returns counters for the database's open data files.
+func (db *DB) FileStats() FileStats {
+	return db.files.Stats()
+}
+
+// UseCodec sets the codec for values read from or written to a data file.
+// A nil codec restores the default chosen by CodecFor. Buckets already
+// written with another codec will return ErrDifferentCodec until migrated
+// with MigrateCodec.
+func (db *DB) UseCodec(f DataFile, c Codec) {
+	db.codecs.Lock()
+	defer db.codecs.Unlock()
+
+	if c == nil {
+		delete(db.codecs.byFile, f)
+		return
+	}
+	db.codecs.byFile[f] = c
+}
+
+// codecFor returns the codec for a value in a data file.
+func (db *DB) codecFor(f DataFile, v interface{}) Codec {
+	db.codecs.RLock()
+	c, ok := db.codecs.byFile[f]
+	db.codecs.RUnlock()
+
+	if ok {
+		return c
+	}
+	return CodecFor(v)
+}
+
+// openPath returns a lease on the data file at a path.
+func (db *DB) openPath(p string) (*Lease, error) {
+	return db.files.Connect(p)
 }
 
-func Close() {
-	dataFiles.CloseAll()
+// Close all open data files. Files in use by a transaction are closed when
+// the transaction ends.
+func (db *DB) Close() error {
+	return db.files.CloseAll()
 }
 
-// Reset sets Ready to false and clears data file paths.
-func Reset() {
-	Close()
-	Ready = false
-	rootPath = ""
-	path = make(map[DataFile]string)
+// Reset closes the database and clears data file paths. Codecs chosen with
+// UseCodec are kept.
+func (db *DB) Reset() {
+	db.Close()
+	db.ready = false
+	db.root = ""
+	db.quota = Quota{}
+	db.path = make(map[DataFile]string)
 }
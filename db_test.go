@@ -7,11 +7,10 @@ import (
 
 	"github.com/stretchr/testify/assert"
 
-	"toba.io/lib/config"
-	"toba.io/lib/db"
-	"toba.io/lib/db/key"
-	"toba.io/lib/db/schema"
-	"toba.io/lib/db/store"
+	db "github.com/toba/pbdb"
+	"github.com/toba/pbdb/key"
+	"github.com/toba/pbdb/schema"
+	"github.com/toba/pbdb/store"
 )
 
 const (
@@ -37,7 +36,7 @@ func TestUninitialized(t *testing.T) {
 	db.Reset()
 
 	t.Run("Uninitialized", func(t *testing.T) {
-		_, err := db.Open(db.SystemFile)
+		_, err := db.OpenDataFile(db.SystemFile)
 		assert.Equal(t, db.ErrNotInitialized, err)
 	})
 }
@@ -53,7 +52,7 @@ func TestConnection(t *testing.T) {
 
 	name := "test.db"
 
-	db.Initialize(config.Database{
+	db.Initialize(db.Options{
 		Path: dir,
 		Name: name,
 	})
@@ -73,3 +72,31 @@ func TestConnection(t *testing.T) {
 		cn.Close()
 	})
 }
+
+func TestOpen(t *testing.T) {
+	var dbs []*db.DB
+
+	for i := 0; i < 2; i++ {
+		dir, err := ioutil.TempDir(os.TempDir(), "toba")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		d, err := db.Open(db.Options{Path: dir, Name: "test.db"})
+		assert.NoError(t, err)
+		assert.True(t, d.Ready())
+		defer d.Close()
+
+		dbs = append(dbs, d)
+	}
+
+	k, err := dbs[0].SystemAdd(&TestLog{Message: "only in first"})
+	assert.NoError(t, err)
+
+	exists, err := dbs[0].SystemHasKey([]byte("TestLog"), k)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	// the second database has its own files
+	_, err = dbs[1].SystemHasKey([]byte("TestLog"), k)
+	assert.Equal(t, db.ErrNoBucket, err)
+}
@@ -0,0 +1,285 @@
+package pbdb
+
+import (
+	"github.com/toba/pbdb/engine"
+	"github.com/toba/pbdb/index"
+	"github.com/toba/pbdb/store"
+)
+
+// std is the default database used by package functions. It is opened by
+// Initialize.
+var std = newDB()
+
+// Default returns the database used by package functions.
+func Default() *DB { return std }
+
+// Ready indicates the default database files have been created and write
+// access validated.
+func Ready() bool { return std.Ready() }
+
+// OpenDataFile returns connection to specific data file.
+func OpenDataFile(f DataFile) (engine.Engine, error) {
+	return std.OpenDataFile(f)
+}
+
+// OpenFile returns a connection to the named file within the root path.
+func OpenFile(name string) (engine.Engine, error) {
+	return std.OpenFile(name)
+}
+
+// UseCodec sets the codec for values read from or written to a data file of
+// the default database.
+func UseCodec(f DataFile, c Codec) { std.UseCodec(f, c) }
+
+// Close all data files of the default database.
+func Close() error { return std.Close() }
+
+// Reset closes the default database and clears data file paths.
+func Reset() { std.Reset() }
+
+// SystemHas indicates whether the system data file contains a value.
+func SystemHas(v store.Value) (bool, error) {
+	return std.SystemHas(v)
+}
+
+// SystemHasKey indicates whether a bucket in the system data file contains a
+// key.
+func SystemHasKey(bucketName, key []byte) (bool, error) {
+	return std.SystemHasKey(bucketName, key)
+}
+
+// SystemAdd adds a value to the system data file.
+func SystemAdd(v store.Value) ([]byte, error) {
+	return std.SystemAdd(v)
+}
+
+// TenantHas indicates whether a tenant data file contains a value.
+func TenantHas(tenantID []byte, v store.Value) (bool, error) {
+	return std.TenantHas(tenantID, v)
+}
+
+// TenantHasKey indicates whether a bucket in a tenant data file contains a
+// key.
+func TenantHasKey(tenantID, bucketName, key []byte) (bool, error) {
+	return std.TenantHasKey(tenantID, bucketName, key)
+}
+
+// TenantGet a value from a tenant data file based on an example value.
+func TenantGet(tenantID []byte, v store.Value) (store.Value, error) {
+	return std.TenantGet(tenantID, v)
+}
+
+// TenantQuery returns every item in a tenant data file matching an example
+// value.
+func TenantQuery(tenantID []byte, example store.Value) ([]store.Value, error) {
+	return std.TenantQuery(tenantID, example)
+}
+
+// TenantQueryRange returns the items in a tenant data file with values in a
+// range of an index.
+func TenantQueryRange(tenantID []byte, example store.Value, indexName, min, max []byte, opts *index.QueryOptions) ([]store.Value, error) {
+	return std.TenantQueryRange(tenantID, example, indexName, min, max, opts)
+}
+
+// TenantQueryPrefixRange returns the items in a tenant data file with values
+// in a range of an index following a prefix.
+func TenantQueryPrefixRange(tenantID []byte, example store.Value, indexName, prefix, min, max []byte, opts *index.QueryOptions) ([]store.Value, error) {
+	return std.TenantQueryPrefixRange(tenantID, example, indexName, prefix, min, max, opts)
+}
+
+// TenantAdd adds a value and its indexes to a tenant data file.
+func TenantAdd(tenantID []byte, v store.Value) ([]byte, error) {
+	return std.TenantAdd(tenantID, v)
+}
+
+// TenantUpdate replaces an existing value in a tenant data file.
+func TenantUpdate(tenantID, k []byte, v store.Value) error {
+	return std.TenantUpdate(tenantID, k, v)
+}
+
+// TenantDelete removes the item at a key in a tenant data file along with
+// every index entry referencing it.
+func TenantDelete(tenantID, k []byte, v store.Value) error {
+	return std.TenantDelete(tenantID, k, v)
+}
+
+// TenantDeleteMatching removes all items in a tenant data file matching an
+// example value, returning the number of items removed.
+func TenantDeleteMatching(tenantID []byte, example store.Value) (int, error) {
+	return std.TenantDeleteMatching(tenantID, example)
+}
+
+// TenantWriter executes a function within a writable transaction on a
+// tenant data file.
+func TenantWriter(tenantID []byte, fn TxFunc) error {
+	return std.TenantWriter(tenantID, fn)
+}
+
+// TenantReader executes a function within a read-only transaction on a
+// tenant data file.
+func TenantReader(tenantID []byte, fn TxFunc) error {
+	return std.TenantReader(tenantID, fn)
+}
+
+// Update executes a function within a writable transaction on a data file.
+func Update(f DataFile, fn TxFunc) error {
+	return std.Update(f, fn)
+}
+
+// View executes a function within a read-only transaction on a data file.
+func View(f DataFile, fn TxFunc) error {
+	return std.View(f, fn)
+}
+
+// TenantIndexes returns the catalog entries for the indexes of a bucket in a
+// tenant data file.
+func TenantIndexes(tenantID, bucketName []byte) ([]*index.Info, error) {
+	return std.TenantIndexes(tenantID, bucketName)
+}
+
+// Has indicates if data file has value.
+func Has(f DataFile, v store.Value) (bool, error) {
+	return std.Has(f, v)
+}
+
+// HasKey indicates if a bucket contains a key.
+func HasKey(f DataFile, bucketName, key []byte) (bool, error) {
+	return std.HasKey(f, bucketName, key)
+}
+
+// Get a value from the data file based on an example value.
+func Get(f DataFile, v store.Value) (store.Value, error) {
+	return std.Get(f, v)
+}
+
+// Query returns every item in a data file matching an example value.
+func Query(f DataFile, example store.Value) ([]store.Value, error) {
+	return std.Query(f, example)
+}
+
+// QueryRange returns the items in a data file with values in a range of an
+// index.
+func QueryRange(f DataFile, example store.Value, indexName, min, max []byte, opts *index.QueryOptions) ([]store.Value, error) {
+	return std.QueryRange(f, example, indexName, min, max, opts)
+}
+
+// QueryPrefixRange returns the items in a data file with values in a range of
+// an index following a prefix.
+func QueryPrefixRange(f DataFile, example store.Value, indexName, prefix, min, max []byte, opts *index.QueryOptions) ([]store.Value, error) {
+	return std.QueryPrefixRange(f, example, indexName, prefix, min, max, opts)
+}
+
+// Add a value and its indexes to a data file.
+func Add(f DataFile, v store.Value) ([]byte, error) {
+	return std.Add(f, v)
+}
+
+// UpdateItem replaces an existing value in a data file.
+func UpdateItem(f DataFile, k []byte, v store.Value) error {
+	return std.UpdateItem(f, k, v)
+}
+
+// Delete removes the item at a key along with every index entry referencing
+// it.
+func Delete(f DataFile, k []byte, v store.Value) error {
+	return std.Delete(f, k, v)
+}
+
+// DeleteMatching removes all items matching an example value, and their
+// index entries, returning the number of items removed.
+func DeleteMatching(f DataFile, example store.Value) (int, error) {
+	return std.DeleteMatching(f, example)
+}
+
+// Indexes returns the catalog entries for the indexes of a bucket in a data
+// file.
+func Indexes(f DataFile, bucketName []byte) ([]*index.Info, error) {
+	return std.Indexes(f, bucketName)
+}
+
+// MigrateCodec re-encodes every item in the bucket of an example value with
+// a different codec and records the new codec for the bucket.
+func MigrateCodec(f DataFile, example store.Value, to Codec) error {
+	return std.MigrateCodec(f, example, to)
+}
+
+// BuildIndex adds every item in the bucket of an example value to the index
+// named by a definition, in batches so writers aren't blocked.
+func BuildIndex(f DataFile, example store.Value, d *index.Definition, o *BuildOptions) error {
+	return std.BuildIndex(f, example, d, o)
+}
+
+// RebuildIndex removes an index and builds it again.
+func RebuildIndex(f DataFile, example store.Value, d *index.Definition, o *BuildOptions) error {
+	return std.RebuildIndex(f, example, d, o)
+}
+
+// TenantBuildIndex adds every item in the bucket of an example value in a
+// tenant data file to the index named by a definition.
+func TenantBuildIndex(tenantID []byte, example store.Value, d *index.Definition, o *BuildOptions) error {
+	return std.TenantBuildIndex(tenantID, example, d, o)
+}
+
+// TenantRebuildIndex removes an index from a tenant data file and builds it
+// again.
+func TenantRebuildIndex(tenantID []byte, example store.Value, d *index.Definition, o *BuildOptions) error {
+	return std.TenantRebuildIndex(tenantID, example, d, o)
+}
+
+// MigrateIndexKeys rewrites the keys of every legacy non-unique index in a
+// data file.
+func MigrateIndexKeys(f DataFile) (int, error) { return std.MigrateIndexKeys(f) }
+
+// TenantMigrateIndexKeys rewrites the keys of every legacy non-unique index
+// in a tenant data file.
+func TenantMigrateIndexKeys(tenantID []byte) (int, error) {
+	return std.TenantMigrateIndexKeys(tenantID)
+}
+
+// VerifyIndexes compares the indexes of a data file with the index maps of
+// its items, optionally repairing missing and orphaned entries.
+func VerifyIndexes(f DataFile, repair bool, examples ...store.Value) (*IndexReport, error) {
+	return std.VerifyIndexes(f, repair, examples...)
+}
+
+// TenantVerifyIndexes compares the indexes of a tenant data file with the
+// index maps of its items, optionally repairing missing and orphaned entries.
+func TenantVerifyIndexes(tenantID []byte, repair bool, examples ...store.Value) (*IndexReport, error) {
+	return std.TenantVerifyIndexes(tenantID, repair, examples...)
+}
+
+// CreateTenant creates a data file for a new tenant and returns the tenant
+// ID.
+func CreateTenant() ([]byte, error) { return std.CreateTenant() }
+
+// ListTenants returns the IDs of every tenant with a data file.
+func ListTenants() ([][]byte, error) { return std.ListTenants() }
+
+// DeleteTenant closes and removes a tenant data file.
+func DeleteTenant(tenantID []byte) error { return std.DeleteTenant(tenantID) }
+
+// RenameTenant moves a tenant data file to a new tenant ID.
+func RenameTenant(tenantID, newID []byte) error {
+	return std.RenameTenant(tenantID, newID)
+}
+
+// TenantInfo returns the size, modification time and bucket counts of a
+// tenant data file.
+func TenantInfo(tenantID []byte) (*TenantFile, error) {
+	return std.TenantInfo(tenantID)
+}
+
+// TenantUsage returns the recorded storage used by a tenant.
+func TenantUsage(tenantID []byte) (*Usage, error) {
+	return std.TenantUsage(tenantID)
+}
+
+// TenantQuota returns the quota limiting a tenant's storage.
+func TenantQuota(tenantID []byte) (Quota, error) {
+	return std.TenantQuota(tenantID)
+}
+
+// SetTenantQuota records a quota for a tenant in place of the default.
+func SetTenantQuota(tenantID []byte, q Quota) error {
+	return std.SetTenantQuota(tenantID, q)
+}
@@ -0,0 +1,418 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+
+	"github.com/dgraph-io/badger"
+)
+
+type (
+	badgerEngine struct {
+		db   *badger.DB
+		path string
+	}
+
+	badgerTx struct {
+		txn      *badger.Txn
+		writable bool
+	}
+
+	// badgerBucket emulates a Bolt bucket by prefixing every key with the
+	// bucket name. Badger has a single flat keyspace.
+	badgerBucket struct {
+		tx     *badgerTx
+		prefix []byte
+	}
+
+	// badgerCursor reads entries in batches so no Badger iterator is left
+	// open between calls. Read-write Badger transactions allow only one
+	// iterator at a time and index operations routinely nest cursors.
+	badgerCursor struct {
+		bucket  *badgerBucket
+		batch   []entry
+		pos     int
+		reverse bool
+		// limit is the number of entries the last batch could hold.
+		limit int
+	}
+
+	entry struct{ key, value []byte }
+)
+
+const (
+	// bucketMarker begins keys recording that a bucket exists.
+	bucketMarker byte = 0x00
+	// itemMarker begins keys of bucket entries, followed by the two byte
+	// length of the bucket name, the bucket name and the entry key.
+	itemMarker byte = 0x01
+
+	// firstCursorBatch is the number of entries a cursor reads after it's
+	// positioned. Each following batch is twice as large up to cursorBatch.
+	// Every entry read is checked for conflicts when a read-write
+	// transaction commits so short scans shouldn't read far ahead.
+	firstCursorBatch = 8
+	// cursorBatch is the most entries a cursor reads at a time.
+	cursorBatch = 100
+
+	// maxConflicts is the number of times Update executes a function whose
+	// transaction conflicts with another before returning the conflict.
+	maxConflicts = 100
+)
+
+// ErrTxnTooBig is returned by Badger when a transaction has more changes
+// than it can hold.
+var ErrTxnTooBig = badger.ErrTxnTooBig
+
+func openBadger(path string) (Engine, error) {
+	opts := badger.DefaultOptions(path)
+	opts.Logger = nil
+
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &badgerEngine{db: db, path: path}, nil
+}
+
+func (e *badgerEngine) Begin(writable bool) (Tx, error) {
+	return &badgerTx{txn: e.db.NewTransaction(writable), writable: writable}, nil
+}
+
+// Update executes the function again in a new transaction if the transaction
+// conflicts with another committed since it began. Bolt has one writer at a
+// time so its transactions never conflict.
+func (e *badgerEngine) Update(fn func(Tx) error) error {
+	for attempt := 1; ; attempt++ {
+		err := e.update(fn)
+		if err != badger.ErrConflict || attempt >= maxConflicts {
+			return err
+		}
+	}
+}
+
+// update executes a function within a single writable transaction.
+func (e *badgerEngine) update(fn func(Tx) error) error {
+	tx, _ := e.Begin(true)
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (e *badgerEngine) View(fn func(Tx) error) error {
+	tx, _ := e.Begin(false)
+	defer tx.Rollback()
+
+	return fn(tx)
+}
+
+// DeleteBucket removes the entries read at the start in as many transactions
+// as they need then removes the bucket, along with any entries added since,
+// in a final transaction.
+func (e *badgerEngine) DeleteBucket(name []byte) error {
+	for {
+		var keys [][]byte
+
+		e.View(func(tx Tx) error {
+			keys = tx.(*badgerTx).entryKeys(name)
+			return nil
+		})
+		for len(keys) > 0 {
+			var n int
+			err := e.Update(func(tx Tx) error {
+				var err error
+				n, err = tx.(*badgerTx).deleteKeys(keys)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			keys = keys[n:]
+		}
+		err := e.Update(func(tx Tx) error {
+			return tx.DeleteBucket(name)
+		})
+		if err != ErrTxnTooBig {
+			return err
+		}
+	}
+}
+
+func (e *badgerEngine) Path() string { return e.path }
+func (e *badgerEngine) Close() error { return e.db.Close() }
+
+func (t *badgerTx) Bucket(name []byte) Bucket {
+	if len(name) == 0 || len(name) > math.MaxUint16 {
+		return nil
+	}
+	if _, err := t.txn.Get(bucketKey(name)); err != nil {
+		return nil
+	}
+	return makeBadgerBucket(t, name)
+}
+
+func (t *badgerTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	if len(name) == 0 {
+		return nil, ErrBucketNameRequired
+	}
+	if len(name) > math.MaxUint16 {
+		return nil, ErrBucketNameTooLarge
+	}
+	if b := t.Bucket(name); b != nil {
+		return b, nil
+	}
+	if err := t.txn.Set(bucketKey(name), []byte{}); err != nil {
+		return nil, err
+	}
+	return makeBadgerBucket(t, name), nil
+}
+
+// DeleteBucket removes every entry having the bucket prefix followed by the
+// bucket marker itself, all in one transaction.
+func (t *badgerTx) DeleteBucket(name []byte) error {
+	if t.Bucket(name) == nil {
+		return nil
+	}
+	keys := t.entryKeys(name)
+	n, err := t.deleteKeys(keys)
+	if err != nil {
+		return err
+	}
+	if n < len(keys) {
+		return ErrTxnTooBig
+	}
+	return t.txn.Delete(bucketKey(name))
+}
+
+// entryKeys returns the full key of every bucket entry. Keys are read before
+// any are deleted since each iterator in a read-write transaction sorts every
+// change the transaction has made.
+func (t *badgerTx) entryKeys(name []byte) [][]byte {
+	b := makeBadgerBucket(t, name)
+	var keys [][]byte
+
+	b.ForEach(func(k, v []byte) error {
+		keys = append(keys, b.key(k))
+		return nil
+	})
+	return keys
+}
+
+// deleteKeys removes keys until the transaction is too big to hold another
+// change, returning the number removed.
+func (t *badgerTx) deleteKeys(keys [][]byte) (int, error) {
+	for i, k := range keys {
+		if err := t.txn.Delete(k); err != nil {
+			if err == ErrTxnTooBig {
+				return i, nil
+			}
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
+
+// ForEachBucket reads every bucket marker before executing the function so
+// no iterator is open while it runs.
+func (t *badgerTx) ForEachBucket(fn func(name []byte) error) error {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	prefix := []byte{bucketMarker}
+	var names [][]byte
+
+	it := t.txn.NewIterator(opts)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		names = append(names, it.Item().KeyCopy(nil)[len(prefix):])
+	}
+	it.Close()
+
+	for _, name := range names {
+		if err := fn(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *badgerTx) Writable() bool { return t.writable }
+func (t *badgerTx) Commit() error  { return t.txn.Commit() }
+
+// Rollback discards the transaction. It is safe to call after Commit.
+func (t *badgerTx) Rollback() error {
+	t.txn.Discard()
+	return nil
+}
+
+func makeBadgerBucket(t *badgerTx, name []byte) *badgerBucket {
+	prefix := make([]byte, 3, 3+len(name))
+	prefix[0] = itemMarker
+	binary.BigEndian.PutUint16(prefix[1:], uint16(len(name)))
+
+	return &badgerBucket{tx: t, prefix: append(prefix, name...)}
+}
+
+// bucketKey is the key recording that a bucket exists.
+func bucketKey(name []byte) []byte {
+	return append([]byte{bucketMarker}, name...)
+}
+
+func (b *badgerBucket) key(k []byte) []byte {
+	full := make([]byte, 0, len(b.prefix)+len(k))
+	return append(append(full, b.prefix...), k...)
+}
+
+func (b *badgerBucket) Get(k []byte) []byte {
+	item, err := b.tx.txn.Get(b.key(k))
+	if err != nil {
+		return nil
+	}
+	v, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil
+	}
+	if v == nil {
+		// distinguish an empty value from a missing key
+		v = []byte{}
+	}
+	return v
+}
+
+// Put copies the value since Badger holds a reference until commit.
+func (b *badgerBucket) Put(k, v []byte) error {
+	if len(k) == 0 {
+		return ErrKeyRequired
+	}
+	return b.tx.txn.Set(b.key(k), append([]byte{}, v...))
+}
+
+func (b *badgerBucket) Delete(k []byte) error {
+	return b.tx.txn.Delete(b.key(k))
+}
+
+func (b *badgerBucket) ForEach(fn func(k, v []byte) error) error {
+	c := b.Cursor()
+
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *badgerBucket) Cursor() Cursor { return &badgerCursor{bucket: b} }
+func (b *badgerBucket) Writable() bool { return b.tx.writable }
+
+func (c *badgerCursor) First() ([]byte, []byte) {
+	return c.load(c.bucket.prefix, false, false, firstCursorBatch)
+}
+
+// Last reverse seeks from the first key beyond the bucket prefix. That key
+// can never itself be an entry because entry keys are longer than prefixes
+// with the same length field.
+func (c *badgerCursor) Last() ([]byte, []byte) {
+	return c.load(afterPrefix(c.bucket.prefix), true, false, firstCursorBatch)
+}
+
+func (c *badgerCursor) Seek(seek []byte) ([]byte, []byte) {
+	return c.load(c.bucket.key(seek), false, false, firstCursorBatch)
+}
+
+func (c *badgerCursor) Next() ([]byte, []byte) {
+	return c.move(false)
+}
+
+func (c *badgerCursor) Prev() ([]byte, []byte) {
+	return c.move(true)
+}
+
+// move advances within the current batch if it's in the same direction and
+// otherwise loads a new batch beginning after the current key. Batches in the
+// same direction grow until they reach cursorBatch.
+func (c *badgerCursor) move(reverse bool) ([]byte, []byte) {
+	if c.pos >= len(c.batch) {
+		return nil, nil
+	}
+	limit := firstCursorBatch
+
+	if c.reverse == reverse {
+		c.pos++
+		if c.pos < len(c.batch) {
+			return c.current()
+		}
+		if len(c.batch) < c.limit {
+			// the last load reached the end of the bucket
+			return nil, nil
+		}
+		c.pos--
+		if limit = c.limit * 2; limit > cursorBatch {
+			limit = cursorBatch
+		}
+	}
+	return c.load(c.bucket.key(c.batch[c.pos].key), reverse, true, limit)
+}
+
+func (c *badgerCursor) current() ([]byte, []byte) {
+	if c.pos < len(c.batch) {
+		e := c.batch[c.pos]
+		return e.key, e.value
+	}
+	return nil, nil
+}
+
+// load reads up to limit entries beginning at the full seek key. If after is
+// true then an entry matching the seek key is skipped. Reading stops early if
+// a value can't be copied.
+func (c *badgerCursor) load(seek []byte, reverse, after bool, limit int) ([]byte, []byte) {
+	opts := badger.DefaultIteratorOptions
+	opts.Reverse = reverse
+	opts.PrefetchSize = limit
+
+	it := c.bucket.tx.txn.NewIterator(opts)
+	defer it.Close()
+
+	prefix := c.bucket.prefix
+	c.batch = make([]entry, 0, limit)
+	c.pos = 0
+	c.reverse = reverse
+	c.limit = limit
+
+	for it.Seek(seek); it.Valid() && len(c.batch) < limit; it.Next() {
+		item := it.Item()
+		k := item.Key()
+
+		if !bytes.HasPrefix(k, prefix) {
+			break
+		}
+		if after && bytes.Equal(k, seek) {
+			continue
+		}
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			break
+		}
+		if v == nil {
+			v = []byte{}
+		}
+		c.batch = append(c.batch, entry{key: item.KeyCopy(nil)[len(prefix):], value: v})
+	}
+	return c.current()
+}
+
+// afterPrefix returns the smallest key greater than every key having the
+// prefix.
+func afterPrefix(prefix []byte) []byte {
+	after := append([]byte{}, prefix...)
+
+	for i := len(after) - 1; i >= 0; i-- {
+		if after[i] < 0xFF {
+			after[i]++
+			return after[:i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package engine
+
+import (
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+type (
+	boltEngine struct{ db *bolt.DB }
+	boltTx     struct{ tx *bolt.Tx }
+
+	// boltBucket only needs to adapt the cursor type since a Bolt cursor
+	// already has the methods of Cursor.
+	boltBucket struct{ *bolt.Bucket }
+)
+
+func openBolt(path string) (Engine, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &boltEngine{db: db}, nil
+}
+
+func (e *boltEngine) Begin(writable bool) (Tx, error) {
+	tx, err := e.db.Begin(writable)
+	if err != nil {
+		return nil, err
+	}
+	return &boltTx{tx: tx}, nil
+}
+
+func (e *boltEngine) Update(fn func(Tx) error) error {
+	return e.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (e *boltEngine) View(fn func(Tx) error) error {
+	return e.db.View(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (e *boltEngine) DeleteBucket(name []byte) error {
+	return e.Update(func(tx Tx) error {
+		return tx.DeleteBucket(name)
+	})
+}
+
+func (e *boltEngine) Path() string { return e.db.Path() }
+func (e *boltEngine) Close() error { return e.db.Close() }
+
+func (t *boltTx) Bucket(name []byte) Bucket {
+	b := t.tx.Bucket(name)
+	if b == nil {
+		return nil
+	}
+	return boltBucket{b}
+}
+
+func (t *boltTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	b, err := t.tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return boltBucket{b}, nil
+}
+
+func (t *boltTx) DeleteBucket(name []byte) error {
+	err := t.tx.DeleteBucket(name)
+	if err == bolt.ErrBucketNotFound {
+		return nil
+	}
+	return err
+}
+
+func (t *boltTx) ForEachBucket(fn func(name []byte) error) error {
+	return t.tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		return fn(name)
+	})
+}
+
+func (t *boltTx) Writable() bool  { return t.tx.Writable() }
+func (t *boltTx) Commit() error   { return t.tx.Commit() }
+func (t *boltTx) Rollback() error { return t.tx.Rollback() }
+
+func (b boltBucket) Cursor() Cursor { return b.Bucket.Cursor() }
@@ -0,0 +1,119 @@
+// Package engine abstracts the key-value store underlying data files so the
+// same item and index logic can run on either Bolt or Badger.
+package engine
+
+import "errors"
+
+type (
+	// Kind identifies a storage engine implementation.
+	Kind int
+
+	// Engine is an open data file.
+	Engine interface {
+		// Begin starts a transaction. Writable transactions must be
+		// committed or rolled back by the caller.
+		Begin(writable bool) (Tx, error)
+		// Update executes a function within a writable transaction that is
+		// committed if the function returns no error. Badger executes the
+		// function again if its transaction conflicts with another so the
+		// function shouldn't change anything outside the transaction.
+		Update(fn func(Tx) error) error
+		// View executes a function within a read-only transaction.
+		View(fn func(Tx) error) error
+		// DeleteBucket removes a bucket and all of its keys in transactions
+		// of its own. Bolt uses one transaction but Badger uses as many as
+		// it needs to delete a large bucket, so unlike Tx.DeleteBucket an
+		// interrupted delete may leave some keys behind. There is no error if
+		// the bucket doesn't exist.
+		DeleteBucket(name []byte) error
+		// Path is the file or directory the engine was opened at.
+		Path() string
+		// Close releases the data file.
+		Close() error
+	}
+
+	// Tx is a read-only or read-write transaction.
+	Tx interface {
+		// Bucket returns the named bucket or nil if it doesn't exist.
+		Bucket(name []byte) Bucket
+		// CreateBucketIfNotExists returns the named bucket, creating it
+		// first if necessary.
+		CreateBucketIfNotExists(name []byte) (Bucket, error)
+		// DeleteBucket removes a bucket and all of its keys. Badger returns
+		// ErrTxnTooBig if the bucket has more keys than one transaction can
+		// change. Engine.DeleteBucket removes those.
+		DeleteBucket(name []byte) error
+		// ForEachBucket executes a function for the name of every bucket in
+		// byte-sorted order, stopping at the first error.
+		ForEachBucket(fn func(name []byte) error) error
+		Writable() bool
+		Commit() error
+		Rollback() error
+	}
+
+	// Bucket is a named collection of keys, called a keyspace by some
+	// engines.
+	Bucket interface {
+		// Get returns the value for a key or nil if the key doesn't exist.
+		Get(key []byte) []byte
+		Put(key, value []byte) error
+		Delete(key []byte) error
+		// ForEach executes a function for every key and value in the bucket,
+		// stopping at the first error.
+		ForEach(fn func(k, v []byte) error) error
+		Cursor() Cursor
+		Writable() bool
+	}
+
+	// Cursor iterates over bucket keys in byte-sorted order. Methods return
+	// nil keys and values when the cursor moves beyond either end of the
+	// bucket.
+	Cursor interface {
+		First() (key, value []byte)
+		Last() (key, value []byte)
+		Next() (key, value []byte)
+		Prev() (key, value []byte)
+		// Seek moves to the given key or, if it doesn't exist, to the next
+		// key after it.
+		Seek(seek []byte) (key, value []byte)
+	}
+)
+
+const (
+	// Bolt stores each data file as a single B+tree file.
+	// See https://github.com/etcd-io/bbolt
+	Bolt Kind = iota
+	// Badger stores each data file as an LSM tree directory.
+	// See https://github.com/dgraph-io/badger
+	Badger
+)
+
+var (
+	ErrUnknownEngine      = errors.New("unknown storage engine")
+	ErrBucketNameRequired = errors.New("bucket name required")
+	ErrBucketNameTooLarge = errors.New("bucket name too large")
+	ErrKeyRequired        = errors.New("key required")
+)
+
+// Open returns a data file at path using the given engine. The file is
+// created if it doesn't exist.
+func Open(k Kind, path string) (Engine, error) {
+	switch k {
+	case Bolt:
+		return openBolt(path)
+	case Badger:
+		return openBadger(path)
+	}
+	return nil, ErrUnknownEngine
+}
+
+// String returns the engine name.
+func (k Kind) String() string {
+	switch k {
+	case Bolt:
+		return "bolt"
+	case Badger:
+		return "badger"
+	}
+	return "unknown"
+}
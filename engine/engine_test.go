@@ -0,0 +1,317 @@
+package engine_test
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/toba/pbdb/engine"
+)
+
+var (
+	bucketName = []byte("test")
+	keys       = [][]byte{[]byte("aa"), []byte("bb"), []byte("cc"), []byte("dd")}
+)
+
+// withEngines opens a temporary data file for each storage engine.
+func withEngines(t *testing.T, fn func(t *testing.T, db engine.Engine)) {
+	for _, k := range []engine.Kind{engine.Bolt, engine.Badger} {
+		t.Run(k.String(), func(t *testing.T) {
+			dir, err := ioutil.TempDir(os.TempDir(), "toba")
+			assert.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			db, err := engine.Open(k, dir+string(os.PathSeparator)+"test.db")
+			assert.NoError(t, err)
+			defer db.Close()
+
+			fn(t, db)
+		})
+	}
+}
+
+// withItems adds keys to the test bucket, with each key as its own value.
+func withItems(t *testing.T, fn func(t *testing.T, db engine.Engine)) {
+	withEngines(t, func(t *testing.T, db engine.Engine) {
+		err := db.Update(func(tx engine.Tx) error {
+			b, err := tx.CreateBucketIfNotExists(bucketName)
+			if err != nil {
+				return err
+			}
+			for _, k := range keys {
+				if err := b.Put(k, k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+
+		fn(t, db)
+	})
+}
+
+func TestUnknownEngine(t *testing.T) {
+	_, err := engine.Open(engine.Kind(99), "test.db")
+	assert.Equal(t, engine.ErrUnknownEngine, err)
+}
+
+func TestBucket(t *testing.T) {
+	withEngines(t, func(t *testing.T, db engine.Engine) {
+		db.Update(func(tx engine.Tx) error {
+			assert.True(t, tx.Writable())
+			assert.Nil(t, tx.Bucket(bucketName))
+
+			b, err := tx.CreateBucketIfNotExists(bucketName)
+			assert.NoError(t, err)
+			assert.NotNil(t, b)
+			assert.True(t, b.Writable())
+			assert.NotNil(t, tx.Bucket(bucketName))
+
+			_, err = tx.CreateBucketIfNotExists(nil)
+			assert.Error(t, err)
+
+			return nil
+		})
+
+		db.View(func(tx engine.Tx) error {
+			assert.False(t, tx.Writable())
+			assert.NotNil(t, tx.Bucket(bucketName))
+			return nil
+		})
+
+		db.Update(func(tx engine.Tx) error {
+			assert.NoError(t, tx.DeleteBucket(bucketName))
+			assert.Nil(t, tx.Bucket(bucketName))
+
+			// deleting a non-existent bucket is okay
+			assert.NoError(t, tx.DeleteBucket([]byte("nothing")))
+			return nil
+		})
+	})
+}
+
+func TestForEachBucket(t *testing.T) {
+	withItems(t, func(t *testing.T, db engine.Engine) {
+		db.Update(func(tx engine.Tx) error {
+			_, err := tx.CreateBucketIfNotExists([]byte("another"))
+			assert.NoError(t, err)
+
+			var names [][]byte
+			err = tx.ForEachBucket(func(name []byte) error {
+				// buckets can be used while listing
+				assert.NotNil(t, tx.Bucket(name))
+				names = append(names, name)
+				return nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, [][]byte{[]byte("another"), bucketName}, names)
+			return nil
+		})
+	})
+}
+
+func TestGetPutDelete(t *testing.T) {
+	withItems(t, func(t *testing.T, db engine.Engine) {
+		db.Update(func(tx engine.Tx) error {
+			b := tx.Bucket(bucketName)
+			assert.Equal(t, keys[1], b.Get(keys[1]))
+			assert.Nil(t, b.Get([]byte("nothing")))
+
+			assert.Error(t, b.Put(nil, keys[0]))
+
+			assert.NoError(t, b.Delete(keys[1]))
+			assert.Nil(t, b.Get(keys[1]))
+
+			return nil
+		})
+	})
+}
+
+func TestRollback(t *testing.T) {
+	withItems(t, func(t *testing.T, db engine.Engine) {
+		tx, err := db.Begin(true)
+		assert.NoError(t, err)
+		tx.Bucket(bucketName).Delete(keys[0])
+		assert.NoError(t, tx.Rollback())
+
+		db.View(func(tx engine.Tx) error {
+			assert.NotNil(t, tx.Bucket(bucketName).Get(keys[0]))
+			return nil
+		})
+	})
+}
+
+func TestBucketIsolation(t *testing.T) {
+	withItems(t, func(t *testing.T, db engine.Engine) {
+		db.Update(func(tx engine.Tx) error {
+			// a bucket name that prefixes another must not see its keys
+			b, err := tx.CreateBucketIfNotExists(bucketName[:3])
+			assert.NoError(t, err)
+			assert.NoError(t, b.Put([]byte("zz"), []byte("zz")))
+
+			count := 0
+			b.ForEach(func(k, v []byte) error {
+				count++
+				return nil
+			})
+			assert.Equal(t, 1, count)
+			return nil
+		})
+	})
+}
+
+func TestCursor(t *testing.T) {
+	withItems(t, func(t *testing.T, db engine.Engine) {
+		db.View(func(tx engine.Tx) error {
+			c := tx.Bucket(bucketName).Cursor()
+
+			k, v := c.First()
+			assert.Equal(t, keys[0], k)
+			assert.Equal(t, keys[0], v)
+
+			k, _ = c.Next()
+			assert.Equal(t, keys[1], k)
+
+			k, _ = c.Prev()
+			assert.Equal(t, keys[0], k)
+
+			k, _ = c.Prev()
+			assert.Nil(t, k)
+
+			k, _ = c.Last()
+			assert.Equal(t, keys[3], k)
+
+			k, _ = c.Next()
+			assert.Nil(t, k)
+
+			k, _ = c.Seek([]byte("b"))
+			assert.Equal(t, keys[1], k)
+
+			k, _ = c.Seek([]byte("cc"))
+			assert.Equal(t, keys[2], k)
+
+			k, _ = c.Seek([]byte("zz"))
+			assert.Nil(t, k)
+
+			return nil
+		})
+	})
+}
+
+func TestCursorBatches(t *testing.T) {
+	withEngines(t, func(t *testing.T, db engine.Engine) {
+		const total = 250
+
+		db.Update(func(tx engine.Tx) error {
+			b, _ := tx.CreateBucketIfNotExists(bucketName)
+			for i := 0; i < total; i++ {
+				k := []byte{byte(i / 256), byte(i % 256)}
+				assert.NoError(t, b.Put(k, k))
+			}
+			return nil
+		})
+
+		db.View(func(tx engine.Tx) error {
+			c := tx.Bucket(bucketName).Cursor()
+
+			count := 0
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				count++
+			}
+			assert.Equal(t, total, count)
+
+			count = 0
+			for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+				count++
+			}
+			assert.Equal(t, total, count)
+
+			return nil
+		})
+	})
+}
+
+func TestDeleteLargeBucket(t *testing.T) {
+	withEngines(t, func(t *testing.T, db engine.Engine) {
+		const total, batch = 200000, 20000
+
+		for i := 0; i < total; i += batch {
+			err := db.Update(func(tx engine.Tx) error {
+				b, err := tx.CreateBucketIfNotExists(bucketName)
+				if err != nil {
+					return err
+				}
+				for j := i; j < i+batch; j++ {
+					k := []byte{byte(j >> 16), byte(j >> 8), byte(j)}
+					if err := b.Put(k, k); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			assert.NoError(t, err)
+		}
+
+		// a transaction either deletes the whole bucket or nothing
+		err := db.Update(func(tx engine.Tx) error {
+			return tx.DeleteBucket(bucketName)
+		})
+		if err != nil {
+			assert.Equal(t, engine.ErrTxnTooBig, err)
+
+			db.View(func(tx engine.Tx) error {
+				count := 0
+				tx.Bucket(bucketName).ForEach(func(k, v []byte) error {
+					count++
+					return nil
+				})
+				assert.Equal(t, total, count)
+				return nil
+			})
+		}
+		assert.NoError(t, db.DeleteBucket(bucketName))
+		assert.NoError(t, db.DeleteBucket(bucketName))
+
+		db.View(func(tx engine.Tx) error {
+			assert.Nil(t, tx.Bucket(bucketName))
+			return nil
+		})
+	})
+}
+
+func TestConcurrentUpdate(t *testing.T) {
+	withEngines(t, func(t *testing.T, db engine.Engine) {
+		const writers = 20
+		counter := []byte("counter")
+		var wg sync.WaitGroup
+
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// each increment reads the count written by the others
+				err := db.Update(func(tx engine.Tx) error {
+					b, err := tx.CreateBucketIfNotExists(bucketName)
+					if err != nil {
+						return err
+					}
+					n := 0
+					if v := b.Get(counter); v != nil {
+						n = int(v[0])
+					}
+					return b.Put(counter, []byte{byte(n + 1)})
+				})
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+
+		db.View(func(tx engine.Tx) error {
+			assert.Equal(t, []byte{writers}, tx.Bucket(bucketName).Get(counter))
+			return nil
+		})
+	})
+}
@@ -1,12 +1,43 @@
 package pbdb
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/toba/pbdb/index"
+)
 
 var (
 	ErrNotInitialized      = errors.New("database has not been initialized")
 	ErrInvalidTenant       = errors.New("cannot load database for invalid tenant")
 	ErrInvalidDataFileName = errors.New("invalid data file name")
 	ErrNoBucket            = errors.New("no bucket found with that name")
+	ErrNoIndex             = errors.New("value has no indexed fields to query by")
+	ErrNotProtoMessage     = errors.New("value does not implement proto.Message")
+	ErrUnknownCodec        = errors.New("no codec registered with that name")
+	ErrNotNumeric          = errors.New("value is not a number")
+	ErrFileInUse           = errors.New("data file is in use")
+	ErrTenantExists        = errors.New("tenant already exists")
+	ErrTenantNotFound      = errors.New("tenant not found")
+	// ErrQuotaExceeded matches every QuotaError.
+	ErrQuotaExceeded = errors.New("tenant quota exceeded")
+
+	// ErrAlreadyExists is returned when a value in a unique index is already
+	// indexed to a different item.
+	ErrAlreadyExists = index.ErrAlreadyExists
+	// ErrInvalidIndexKey is returned when indexing an empty value.
+	ErrInvalidIndexKey = index.ErrInvalidIndexKey
+	// ErrInvalidItemKey is returned when indexing an item key that isn't a
+	// ULID.
+	ErrInvalidItemKey = index.ErrInvalidItemKey
+	// ErrIndexMismatch is returned when saving a value whose index map
+	// disagrees with the index catalog of the data file.
+	ErrIndexMismatch = index.ErrIndexMismatch
+
+	// ErrDifferentCodec is returned when using a codec different than the first codec used with the bucket.
+	ErrDifferentCodec = errors.New("the selected codec is incompatible with this bucket")
+
+	// ErrNotFound is returned when the specified record is not saved in the bucket.
+	ErrNotFound = errors.New("not found")
 
 // // ErrNoID is returned when no ID field or id tag is found in the struct.
 // ErrNoID = errors.New("missing struct tag id or ID field")
@@ -17,9 +48,6 @@ var (
 // // ErrBadType is returned when a method receives an unexpected value type.
 // ErrBadType = errors.New("provided data must be a struct or a pointer to struct")
 
-// // ErrAlreadyExists is returned uses when trying to set an existing value on a field that has a unique index.
-// ErrAlreadyExists = errors.New("already exists")
-
 // // ErrNilParam is returned when the specified param is expected to be not nil.
 // ErrNilParam = errors.New("param must not be nil")
 
@@ -38,9 +66,6 @@ var (
 // // ErrNoName is returned when the specified struct has no name.
 // ErrNoName = errors.New("provided target must have a name")
 
-// // ErrNotFound is returned when the specified record is not saved in the bucket.
-// ErrNotFound = errors.New("not found")
-
 // // ErrNotInTransaction is returned when trying to rollback or commit when not in transaction.
 // ErrNotInTransaction = errors.New("not in transaction")
 
@@ -49,7 +74,4 @@ var (
 
 // // ErrIncompatibleValue is returned when trying to set a value with a different type than the chosen field
 // ErrIncompatibleValue = errors.New("incompatible value")
-
-// // ErrDifferentCodec is returned when using a codec different than the first codec used with the bucket.
-// ErrDifferentCodec = errors.New("the selected codec is incompatible with this bucket")
 )
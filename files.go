@@ -1,74 +1,310 @@
 package pbdb
 
 import (
+	"container/list"
 	"sync"
-	"time"
 
-	"github.com/boltdb/bolt"
+	"github.com/toba/pbdb/engine"
 )
 
-// OpenFiles is a thread-safe map of open database files.
-type OpenFiles struct {
-	sync.RWMutex
-	files map[string]*bolt.DB
+type (
+	// OpenFiles is a thread-safe map of open database files. Files are shared
+	// through leases and stay open between leases so they can be reused.
+	OpenFiles struct {
+		sync.Mutex
+		// Kind is the storage engine used to open new files.
+		Kind engine.Kind
+		// Limit is the number of files to keep open. When it is reached the
+		// least recently used file without leases is closed to make room.
+		// Leased files are never closed so the limit is exceeded if every
+		// open file is leased. Zero means no limit.
+		Limit int
+		files map[string]*openFile
+		// opening are files being opened by Connect.
+		opening map[string]*pendingOpen
+		// idle lists the paths of files without leases, most recently
+		// used first.
+		idle  *list.List
+		stats FileStats
+	}
+
+	// openFile is a data file and the number of leases referencing it.
+	openFile struct {
+		db     engine.Engine
+		leases int
+		// closing indicates the file should be closed when the last lease
+		// is released.
+		closing bool
+		// idle is the file's element in the idle list or nil while leased.
+		idle *list.Element
+	}
+
+	// pendingOpen is the result of opening a file, available once done is
+	// closed.
+	pendingOpen struct {
+		done chan struct{}
+		err  error
+	}
+
+	// FileStats are counters for the files in an OpenFiles map.
+	FileStats struct {
+		// Open is the number of files currently open.
+		Open int
+		// Leased is the number of open files with unreleased leases.
+		Leased int
+		// Hits counts connections to files that were already open.
+		Hits uint64
+		// Misses counts connections that had to open a file.
+		Misses uint64
+		// Evictions counts idle files closed to stay within the limit.
+		Evictions uint64
+	}
+
+	// Lease is a reference to a data file held open by OpenFiles. Closing
+	// the lease releases the reference without closing the file for other
+	// users.
+	Lease struct {
+		engine.Engine
+		files *OpenFiles
+		path  string
+		once  sync.Once
+	}
+)
+
+// NewOpenFiles creates an empty map of files opened with a storage engine.
+func NewOpenFiles(kind engine.Kind) *OpenFiles {
+	return &OpenFiles{
+		Kind:    kind,
+		files:   make(map[string]*openFile),
+		opening: make(map[string]*pendingOpen),
+		idle:    list.New(),
+	}
 }
 
-// Connect opens or creates a bolt data file at given path.
-func (o OpenFiles) Connect(path string) (*bolt.DB, error) {
-	if !o.Has(path) {
-		db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
-		if err != nil {
-			return nil, err
+// Connect opens or creates a data file at given path and returns a lease on
+// it. The lease must be closed when no longer needed.
+//
+// A path is opened by only one caller at a time. Concurrent callers for the
+// same path wait for that open to finish and share its result, so they don't
+// contend for the file lock. Opens of other paths are not blocked.
+func (o *OpenFiles) Connect(path string) (*Lease, error) {
+	for {
+		o.Lock()
+		if l := o.lease(path); l != nil {
+			o.Unlock()
+			return l, nil
+		}
+		p, waiting := o.opening[path]
+		if !waiting {
+			break
+		}
+		o.Unlock()
+		<-p.done
+
+		if p.err != nil {
+			return nil, p.err
 		}
-		o.Add(path, db)
+		// the file may have been closed again before it could be leased
+	}
+	p := &pendingOpen{done: make(chan struct{})}
+	o.opening[path] = p
+	o.stats.Misses++
+	// make room for the new file
+	err := o.evict()
+	o.Unlock()
+
+	var db engine.Engine
+	if err == nil {
+		db, err = engine.Open(o.Kind, path)
 	}
-	return o.Get(path), nil
-}
 
-func (o OpenFiles) Add(path string, db *bolt.DB) {
 	o.Lock()
-	o.files[path] = db
+	delete(o.opening, path)
+	if err == nil {
+		o.files[path] = &openFile{db: db, leases: 1}
+	}
+	p.err = err
 	o.Unlock()
+	close(p.done)
+
+	if err != nil {
+		return nil, err
+	}
+	return &Lease{Engine: db, files: o, path: path}, nil
 }
 
-func (o OpenFiles) Remove(path string) {
+// evict closes the least recently used idle files until open files and those
+// being opened are within the limit. The caller must hold the lock.
+func (o *OpenFiles) evict() error {
+	if o.Limit <= 0 {
+		return nil
+	}
+	for len(o.files)+len(o.opening) > o.Limit {
+		last := o.idle.Back()
+		if last == nil {
+			// every file is leased
+			return nil
+		}
+		path := last.Value.(string)
+		f := o.files[path]
+		o.idle.Remove(last)
+		delete(o.files, path)
+		o.stats.Evictions++
+
+		if err := f.db.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats returns counters for the open files.
+func (o *OpenFiles) Stats() FileStats {
 	o.Lock()
-	o.Close(path)
-	delete(o.files, path)
-	o.Unlock()
+	defer o.Unlock()
+
+	s := o.stats
+	s.Open = len(o.files)
+	for _, f := range o.files {
+		if f.leases > 0 {
+			s.Leased++
+		}
+	}
+	return s
 }
 
-func (o OpenFiles) Get(path string) *bolt.DB {
-	o.RLock()
-	db, ok := o.files[path]
-	o.RUnlock()
-	if ok {
-		return db
+// lease returns a new lease on an open file or nil if the file isn't open.
+// The caller must hold the lock.
+func (o *OpenFiles) lease(path string) *Lease {
+	f, ok := o.files[path]
+	if !ok {
+		return nil
 	}
-	return nil
+	if f.idle != nil {
+		o.idle.Remove(f.idle)
+		f.idle = nil
+	}
+	f.leases++
+	f.closing = false
+	o.stats.Hits++
+
+	return &Lease{Engine: f.db, files: o, path: path}
 }
 
-func (o OpenFiles) Has(path string) bool {
-	o.RLock()
+// release removes a lease from an open file, closing the file if it was
+// waiting for the last lease to be released.
+func (o *OpenFiles) release(path string) error {
+	o.Lock()
+	defer o.Unlock()
+
+	f, ok := o.files[path]
+	if !ok {
+		return nil
+	}
+	f.leases--
+
+	if f.leases > 0 {
+		return nil
+	}
+	if f.closing {
+		delete(o.files, path)
+		return f.db.Close()
+	}
+	f.idle = o.idle.PushFront(path)
+
+	// files opened while all others were leased may exceed the limit
+	return o.evict()
+}
+
+// Add an open data file without leasing it.
+func (o *OpenFiles) Add(path string, db engine.Engine) {
+	o.Lock()
+	o.files[path] = &openFile{db: db, idle: o.idle.PushFront(path)}
+	o.Unlock()
+}
+
+// Has indicates whether the data file at a path is open.
+func (o *OpenFiles) Has(path string) bool {
+	o.Lock()
 	_, ok := o.files[path]
-	o.RUnlock()
+	o.Unlock()
 	return ok
 }
 
-// CloseAll closes all data file connections
-// TODO: check if db is open before closing
-func (o OpenFiles) CloseAll() {
-	o.RLock()
-	for _, db := range o.files {
-		db.Close()
+// Leases returns the number of unreleased leases on the data file at a path.
+func (o *OpenFiles) Leases(path string) int {
+	o.Lock()
+	defer o.Unlock()
+
+	if f, ok := o.files[path]; ok {
+		return f.leases
+	}
+	return 0
+}
+
+// CloseAll closes all data file connections. Files with unreleased leases are
+// closed when their last lease is released.
+func (o *OpenFiles) CloseAll() error {
+	o.Lock()
+	defer o.Unlock()
+
+	var first error
+
+	for path := range o.files {
+		if err := o.close(path); err != nil && first == nil {
+			first = err
+		}
 	}
-	o.RUnlock()
+	return first
 }
 
-// Close data file at given path
-// TODO: check if db is open before closing
-func (o OpenFiles) Close(path string) {
-	if db, ok := o.files[path]; ok {
-		db.Close()
+// Close data file at given path. If the file has unreleased leases then it is
+// closed when the last lease is released.
+func (o *OpenFiles) Close(path string) error {
+	o.Lock()
+	defer o.Unlock()
+	return o.close(path)
+}
+
+// Remove closes the data file at a path so it can be moved or deleted.
+// Unlike Close, it returns ErrFileInUse rather than waiting for leases to be
+// released.
+func (o *OpenFiles) Remove(path string) error {
+	o.Lock()
+	defer o.Unlock()
+
+	if _, opening := o.opening[path]; opening {
+		return ErrFileInUse
 	}
+	if f, ok := o.files[path]; ok && f.leases > 0 {
+		return ErrFileInUse
+	}
+	return o.close(path)
+}
+
+// close data file at given path. The caller must hold the lock.
+func (o *OpenFiles) close(path string) error {
+	f, ok := o.files[path]
+	if !ok {
+		return nil
+	}
+	if f.leases > 0 {
+		f.closing = true
+		return nil
+	}
+	if f.idle != nil {
+		o.idle.Remove(f.idle)
+	}
+	delete(o.files, path)
+	return f.db.Close()
+}
+
+// Close releases the lease. The data file remains open for other leases and
+// later connections.
+func (l *Lease) Close() error {
+	var err error
+	l.once.Do(func() {
+		err = l.files.release(l.path)
+	})
+	return err
 }
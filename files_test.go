@@ -1 +1,180 @@
 package pbdb_test
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	db "github.com/toba/pbdb"
+	"github.com/toba/pbdb/engine"
+)
+
+// withOpenFiles creates a temporary directory and file map for each storage
+// engine.
+func withOpenFiles(t *testing.T, fn func(t *testing.T, files *db.OpenFiles, dir string)) {
+	for _, k := range []engine.Kind{engine.Bolt, engine.Badger} {
+		t.Run(k.String(), func(t *testing.T) {
+			dir, err := ioutil.TempDir(os.TempDir(), "toba")
+			assert.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			files := db.NewOpenFiles(k)
+			defer files.CloseAll()
+
+			fn(t, files, dir+string(os.PathSeparator))
+		})
+	}
+}
+
+func TestLeases(t *testing.T) {
+	withOpenFiles(t, func(t *testing.T, files *db.OpenFiles, dir string) {
+		path := dir + "test.db"
+
+		first, err := files.Connect(path)
+		assert.NoError(t, err)
+		second, err := files.Connect(path)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, files.Leases(path))
+
+		// releasing a lease leaves the file open for the other
+		assert.NoError(t, first.Close())
+		assert.NoError(t, first.Close())
+		assert.Equal(t, 1, files.Leases(path))
+
+		err = second.Update(func(tx engine.Tx) error {
+			_, err := tx.CreateBucketIfNotExists([]byte("bucket"))
+			return err
+		})
+		assert.NoError(t, err)
+
+		// idle files stay open for reuse
+		assert.NoError(t, second.Close())
+		assert.True(t, files.Has(path))
+		assert.Equal(t, 0, files.Leases(path))
+
+		third, err := files.Connect(path)
+		assert.NoError(t, err)
+		assert.NoError(t, third.View(func(tx engine.Tx) error {
+			assert.NotNil(t, tx.Bucket([]byte("bucket")))
+			return nil
+		}))
+		assert.NoError(t, third.Close())
+	})
+}
+
+func TestCloseLeased(t *testing.T) {
+	withOpenFiles(t, func(t *testing.T, files *db.OpenFiles, dir string) {
+		path := dir + "test.db"
+
+		l, err := files.Connect(path)
+		assert.NoError(t, err)
+
+		// closing waits for the lease to be released
+		assert.NoError(t, files.Close(path))
+		assert.True(t, files.Has(path))
+		assert.NoError(t, l.View(func(tx engine.Tx) error { return nil }))
+
+		assert.NoError(t, l.Close())
+		assert.False(t, files.Has(path))
+
+		// idle files are closed immediately
+		l, err = files.Connect(path)
+		assert.NoError(t, err)
+		assert.NoError(t, l.Close())
+		assert.NoError(t, files.CloseAll())
+		assert.False(t, files.Has(path))
+	})
+}
+
+func TestFileLimit(t *testing.T) {
+	withOpenFiles(t, func(t *testing.T, files *db.OpenFiles, dir string) {
+		files.Limit = 2
+		paths := []string{dir + "one.db", dir + "two.db", dir + "three.db"}
+
+		for _, p := range paths {
+			l, err := files.Connect(p)
+			assert.NoError(t, err)
+			assert.NoError(t, l.Close())
+		}
+		// the least recently used file is evicted
+		assert.False(t, files.Has(paths[0]))
+		assert.True(t, files.Has(paths[1]))
+		assert.True(t, files.Has(paths[2]))
+
+		stats := files.Stats()
+		assert.Equal(t, 2, stats.Open)
+		assert.Equal(t, uint64(3), stats.Misses)
+		assert.Equal(t, uint64(1), stats.Evictions)
+
+		// using a file makes it the most recently used
+		l, err := files.Connect(paths[1])
+		assert.NoError(t, err)
+		assert.NoError(t, l.Close())
+
+		first, err := files.Connect(paths[0])
+		assert.NoError(t, err)
+		assert.True(t, files.Has(paths[1]))
+		assert.False(t, files.Has(paths[2]))
+
+		// leased files are kept open beyond the limit
+		second, err := files.Connect(paths[1])
+		assert.NoError(t, err)
+		third, err := files.Connect(paths[2])
+		assert.NoError(t, err)
+
+		stats = files.Stats()
+		assert.Equal(t, 3, stats.Open)
+		assert.Equal(t, 3, stats.Leased)
+		assert.Equal(t, uint64(2), stats.Hits)
+
+		// and evicted once released
+		assert.NoError(t, first.Close())
+		assert.False(t, files.Has(paths[0]))
+		assert.NoError(t, second.Close())
+		assert.NoError(t, third.Close())
+		assert.Equal(t, 2, files.Stats().Open)
+	})
+}
+
+func TestConcurrentConnect(t *testing.T) {
+	withOpenFiles(t, func(t *testing.T, files *db.OpenFiles, dir string) {
+		path := dir + "test.db"
+		count := 20
+		leases := make(chan *db.Lease, count)
+		errs := make(chan error, count)
+		var wg sync.WaitGroup
+
+		for i := 0; i < count; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				l, err := files.Connect(path)
+				if err != nil {
+					errs <- err
+					return
+				}
+				leases <- l
+			}()
+		}
+		wg.Wait()
+		close(leases)
+		close(errs)
+
+		for err := range errs {
+			assert.NoError(t, err)
+		}
+		// the file was opened once and shared
+		stats := files.Stats()
+		assert.Equal(t, uint64(1), stats.Misses)
+		assert.Equal(t, uint64(count-1), stats.Hits)
+		assert.Equal(t, count, files.Leases(path))
+
+		for l := range leases {
+			assert.NoError(t, l.Close())
+		}
+		assert.Equal(t, 0, files.Leases(path))
+	})
+}
@@ -0,0 +1,31 @@
+module github.com/toba/pbdb
+
+go 1.21
+
+require (
+	github.com/dgraph-io/badger v1.6.2
+	github.com/golang/protobuf v1.5.4
+	github.com/oklog/ulid v1.3.1
+	github.com/stretchr/testify v1.8.4
+	github.com/vmihailenco/msgpack/v4 v4.3.13
+	go.etcd.io/bbolt v1.3.10
+)
+
+require (
+	github.com/AndreasBriese/bbloom v0.0.0-20190825152654-46b345b51c96 // indirect
+	github.com/OneOfOne/xxhash v1.2.8 // indirect
+	github.com/cespare/xxhash v1.1.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/dgraph-io/ristretto v0.0.2 // indirect
+	github.com/dustin/go-humanize v1.0.0 // indirect
+	github.com/google/go-cmp v0.7.0 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/vmihailenco/tagparser v0.1.1 // indirect
+	golang.org/x/net v0.23.0 // indirect
+	golang.org/x/sys v0.20.0 // indirect
+	google.golang.org/appengine v1.6.8 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
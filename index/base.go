@@ -5,22 +5,26 @@ package index
 import (
 	"bytes"
 
-	"toba.io/lib/oops"
-
-	"github.com/boltdb/bolt"
+	"github.com/toba/pbdb/engine"
 )
 
 type (
-	// baseIndex wraps a Bolt bucket used to store item values mapped back to
-	// their item. It is the basis for the other index types.
-	baseIndex struct{ Bucket *bolt.Bucket }
+	// baseIndex wraps a storage engine bucket used to store item values mapped
+	// back to their item. It is the basis for the other index types.
+	baseIndex struct {
+		Bucket engine.Bucket
+		// Reverse maps each item key plus value back to the value so the
+		// entries for an item can be found without scanning the index. It
+		// is nil for indexes created without one.
+		Reverse engine.Bucket
+	}
 
 	// mapper function returns either the key or value bytes of an index.
 	mapper func(k, v []byte) []byte
 )
 
 // keySeparator is used between the value key and item key to create a unique
-// composite key for non-unique indexes.
+// composite key for legacy non-unique indexes.
 //
 // Example:
 //		key1<0xFF>value1 -> value1
@@ -48,11 +52,42 @@ func (idx *baseIndex) add(valueKey, itemKey []byte) error {
 			return nil
 		}
 		// same value is aleady indexed to a different item key
-		return oops.AlreadyExists
+		return ErrAlreadyExists
 	}
 	return idx.Bucket.Put(valueKey, itemKey)
 }
 
+// addReverse records that an item is indexed to a value.
+func (idx *baseIndex) addReverse(valueKey, itemKey []byte) error {
+	if idx.Reverse == nil {
+		return nil
+	}
+	return idx.Reverse.Put(reverseKey(valueKey, itemKey), valueKey)
+}
+
+// removeReverse removes the record that an item is indexed to a value.
+func (idx *baseIndex) removeReverse(valueKey, itemKey []byte) error {
+	if idx.Reverse == nil {
+		return nil
+	}
+	return idx.Reverse.Delete(reverseKey(valueKey, itemKey))
+}
+
+// valuesWithItem returns the values an item is indexed to using the reverse
+// bucket. It returns false if the index has no reverse bucket.
+func (idx *baseIndex) valuesWithItem(itemKey []byte) ([][]byte, bool) {
+	if idx.Reverse == nil {
+		return nil, false
+	}
+	c := idx.Reverse.Cursor()
+	var values [][]byte
+
+	for k, v := c.Seek(itemKey); k != nil && bytes.HasPrefix(k, itemKey); k, v = c.Next() {
+		values = append(values, append([]byte(nil), v...))
+	}
+	return values, true
+}
+
 // keysWithItem returns all bucket keys for which the item is the value.
 func (idx *baseIndex) keysWithItem(itemKey []byte) [][]byte {
 	c := idx.Bucket.Cursor()
@@ -69,14 +104,29 @@ func (idx *baseIndex) keysWithItem(itemKey []byte) [][]byte {
 	return nil
 }
 
-// keysWithPrefix finds all keys prefixed by a value key plus seperator.
+// keysWithPrefix finds all keys beginning with a prefix.
 func (idx *baseIndex) keysWithPrefix(keyPrefix []byte) [][]byte {
 	return idx.allWithPrefix(keyPrefix, keyMap)
 }
 
-// itemsWithValuePrefix returns all items for keys having a prefix.
-func (idx *baseIndex) itemsWithValuePrefix(keyPrefix []byte) [][]byte {
-	return idx.allWithPrefix(keyPrefix, valueMap)
+// removeValues removes every entry for an item using a function that removes
+// one value. The values are read from the reverse bucket or, for indexes
+// without one, entries are found by scanning the whole index.
+func (idx *baseIndex) removeValues(itemKey []byte, remove func(valueKey, itemKey []byte) error) error {
+	values, ok := idx.valuesWithItem(itemKey)
+	if !ok {
+		return idx.removeItem(itemKey)
+	}
+	for _, v := range values {
+		if err := remove(v, itemKey); err != nil {
+			return err
+		}
+		// the value may be indexed to another item but this record is stale
+		if err := idx.removeReverse(v, itemKey); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // removeItem finds all bucket keys for which the item is a the value and
@@ -96,39 +146,144 @@ func (idx *baseIndex) removeItem(itemKey []byte) error {
 	return nil
 }
 
-// forRange execute a function for each key-value in a range of key values.
-func (idx *baseIndex) forRange(min, max []byte, fn func(k, v []byte) error) error {
+// keyRange bounds the index keys read by page. A nil min or max leaves that
+// end of the range open. If prefix is true then every key beginning with max
+// is also within the range.
+type keyRange struct {
+	min, max []byte
+	prefix   bool
+}
+
+// page returns the item keys for index keys between min and max, inclusive,
+// in the order and with the paging given by query options. A nil min or max
+// leaves that end of the range open. If distinct is true then each item key
+// is returned once and Skip and Limit count distinct item keys.
+//
+// Iteration stops as soon as the limit is reached so large indexes can be
+// paged without reading every key.
+func (idx *baseIndex) page(min, max []byte, opts *QueryOptions, distinct bool) [][]byte {
+	return idx.pageRange(keyRange{min: min, max: max}, opts, distinct)
+}
+
+// pageRange returns the item keys for index keys within a range, as for page.
+func (idx *baseIndex) pageRange(r keyRange, opts *QueryOptions, distinct bool) [][]byte {
+	if opts == nil {
+		opts = NewOptions()
+	}
 	c := idx.Bucket.Cursor()
+	skip := opts.Skip
+	var (
+		list [][]byte
+		seen map[string]bool
+	)
+	if distinct {
+		seen = make(map[string]bool)
+	}
 
-	for k, v := c.Seek(min); v != nil && bytes.Compare(k, max) <= 0; k, v = c.Next() {
-		if err := fn(k, v); err != nil {
-			return err
+	for k, v := r.seek(c, opts.Reverse); k != nil; k, v = nextInRange(c, opts.Reverse) {
+		if r.below(k) || r.above(k) {
+			break
+		}
+		if distinct {
+			if seen[string(v)] {
+				continue
+			}
+			seen[string(v)] = true
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		list = append(list, v)
+
+		if opts.Limit > 0 && len(list) >= opts.Limit {
+			break
 		}
 	}
-	return nil
+	return list
 }
 
-// allInRange returns a list of key or value bytes, using a mapper function,
-// for a range of key values.
-func (idx *baseIndex) allInRange(min, max []byte, m mapper) ([][]byte, error) {
-	var list [][]byte
+// below indicates whether a key sorts before the range.
+func (r keyRange) below(k []byte) bool {
+	return r.min != nil && bytes.Compare(k, r.min) < 0
+}
 
-	idx.forRange(min, max, func(k, v []byte) error {
-		list = append(list, m(k, v))
-		return nil
-	})
+// above indicates whether a key sorts after the range.
+func (r keyRange) above(k []byte) bool {
+	if r.max == nil || bytes.Compare(k, r.max) <= 0 {
+		return false
+	}
+	return !r.prefix || !bytes.HasPrefix(k, r.max)
+}
 
-	return list, nil
+// seek moves a cursor to the first key of the range, which is the last key if
+// iterating in reverse.
+func (r keyRange) seek(c engine.Cursor, reverse bool) ([]byte, []byte) {
+	if !reverse || !r.prefix || r.max == nil {
+		return seekRange(c, r.min, r.max, reverse)
+	}
+	end := prefixEnd(r.max)
+	if end == nil {
+		return c.Last()
+	}
+	if k, _ := c.Seek(end); k == nil {
+		// every key is before the end of the prefix
+		return c.Last()
+	}
+	return c.Prev()
+}
+
+// prefixEnd returns the lowest key greater than every key beginning with a
+// prefix, or nil if there is none because the prefix is only 0xFF bytes.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// seekRange moves a cursor to the first key of a range, which is the last key
+// if iterating in reverse.
+func seekRange(c engine.Cursor, min, max []byte, reverse bool) ([]byte, []byte) {
+	if !reverse {
+		if min == nil {
+			return c.First()
+		}
+		return c.Seek(min)
+	}
+	if max == nil {
+		return c.Last()
+	}
+	k, v := c.Seek(max)
+	if k == nil {
+		// max is beyond the last key
+		return c.Last()
+	}
+	if bytes.Compare(k, max) > 0 {
+		return c.Prev()
+	}
+	return k, v
+}
+
+// nextInRange moves a cursor to the next key in the iteration direction.
+func nextInRange(c engine.Cursor, reverse bool) ([]byte, []byte) {
+	if reverse {
+		return c.Prev()
+	}
+	return c.Next()
 }
 
 // allWithPrefix returns a list of key or value bytes, using a mapper function,
 // for all keys with a given prefix.
-func (idx *baseIndex) allWithPrefix(valueKey []byte, m mapper) [][]byte {
+func (idx *baseIndex) allWithPrefix(prefix []byte, m mapper) [][]byte {
 	c := idx.Bucket.Cursor()
-	prefix := makePrefix(valueKey)
 	var list [][]byte
 
-	for k, v := c.Seek(firstPrefix(valueKey)); bytes.HasPrefix(k, prefix); k, v = c.Next() {
+	for k, v := c.Seek(prefix); bytes.HasPrefix(k, prefix); k, v = c.Next() {
 		list = append(list, m(k, v))
 	}
 
@@ -3,9 +3,13 @@ package index_test
 import (
 	"io/ioutil"
 	"os"
+	"testing"
 
-	"github.com/toba/pbdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/toba/pbdb/engine"
+	"github.com/toba/pbdb/index"
 	"github.com/toba/pbdb/key"
+	"github.com/toba/pbdb/order"
 )
 
 var (
@@ -38,7 +42,37 @@ var (
 	}
 )
 
-func addItems(idx Index) error {
+// addresses are composite country and postal code values, indexed to the
+// item with the same position. They're listed in the order they sort.
+var addresses = [][]byte{
+	composite("CA", "K1A 0B1"),
+	composite("US", "02134"),
+	composite("US", "10001"),
+	composite("US", "10001-1234"),
+	composite("US", "94105"),
+	composite("USA", "00000"),
+}
+
+// composite encodes fields as a tuple.
+func composite(fields ...interface{}) []byte {
+	b, err := order.Tuple(fields...)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// addAddresses indexes each address to its item.
+func addAddresses(idx index.Index) error {
+	for i, a := range addresses {
+		if err := idx.Add(a, items[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addItems(idx index.Index) error {
 	for i := 0; i < 10; i++ {
 		err := idx.Add(values[i], items[i])
 		if err != nil {
@@ -48,13 +82,23 @@ func addItems(idx Index) error {
 	return nil
 }
 
-func connect() (string, *db.Client, error) {
-	dir, err := ioutil.TempDir(os.TempDir(), "toba")
-	if err != nil {
-		return dir, &db.Client{IsConnected: false}, err
-	}
-	path := dir + string(os.PathSeparator) + "test.db"
-	c, err := db.Connect(path)
+// writer creates a temporary data file for each storage engine and passes a
+// writable transaction to the callback. Files are removed after use.
+func writer(t *testing.T, fn func(tx engine.Tx)) {
+	for _, k := range []engine.Kind{engine.Bolt, engine.Badger} {
+		t.Run(k.String(), func(t *testing.T) {
+			dir, err := ioutil.TempDir(os.TempDir(), "toba")
+			assert.NoError(t, err)
+			defer os.RemoveAll(dir)
 
-	return dir, c, err
+			db, err := engine.Open(k, dir+string(os.PathSeparator)+"test.db")
+			assert.NoError(t, err)
+			defer db.Close()
+
+			db.Update(func(tx engine.Tx) error {
+				fn(tx)
+				return nil
+			})
+		})
+	}
 }
@@ -0,0 +1,117 @@
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/toba/pbdb/engine"
+)
+
+// Info describes an index recorded in the catalog of a data file.
+type Info struct {
+	// Name is the index bucket name.
+	Name []byte
+	// ItemBucket is the name of the bucket holding the indexed items.
+	ItemBucket []byte
+	Unique     bool
+	// Source names the field or extractor that produces indexed values. It
+	// is empty if no definition named a source.
+	Source string
+	// Created is when the index was first recorded.
+	Created time.Time
+}
+
+// CatalogBucket records the indexes in a data file by index bucket name. It
+// doesn't start with Prefix so it isn't mistaken for an index.
+var CatalogBucket = []byte("_catalog_")
+
+// Register records the index of a definition in the catalog if it isn't
+// already there. ErrIndexMismatch is returned if the index is recorded with a
+// different item bucket, uniqueness or source.
+func Register(tx engine.Tx, itemBucket []byte, d *Definition) error {
+	info, err := Lookup(tx, d.BucketName)
+	if err != nil {
+		return err
+	}
+	if info != nil {
+		return info.check(itemBucket, d)
+	}
+	catalog, err := tx.CreateBucketIfNotExists(CatalogBucket)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(&Info{
+		Name:       d.BucketName,
+		ItemBucket: itemBucket,
+		Unique:     d.Unique,
+		Source:     d.Source,
+		Created:    time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	return catalog.Put(d.BucketName, data)
+}
+
+// Unregister removes an index from the catalog. There is no error if it
+// isn't recorded.
+func Unregister(tx engine.Tx, name []byte) error {
+	catalog := tx.Bucket(CatalogBucket)
+	if catalog == nil {
+		return nil
+	}
+	return catalog.Delete(name)
+}
+
+// Lookup returns the catalog entry for an index bucket or nil if the index
+// isn't recorded.
+func Lookup(tx engine.Tx, name []byte) (*Info, error) {
+	catalog := tx.Bucket(CatalogBucket)
+	if catalog == nil {
+		return nil, nil
+	}
+	data := catalog.Get(name)
+	if data == nil {
+		return nil, nil
+	}
+	info := &Info{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Catalog returns the indexes recorded for an item bucket, sorted by index
+// name, or every recorded index if the item bucket is nil.
+func Catalog(tx engine.Tx, itemBucket []byte) ([]*Info, error) {
+	catalog := tx.Bucket(CatalogBucket)
+	if catalog == nil {
+		return nil, nil
+	}
+	var list []*Info
+
+	err := catalog.ForEach(func(k, v []byte) error {
+		info := &Info{}
+		if err := json.Unmarshal(v, info); err != nil {
+			return err
+		}
+		if itemBucket == nil || bytes.Equal(info.ItemBucket, itemBucket) {
+			list = append(list, info)
+		}
+		return nil
+	})
+	return list, err
+}
+
+// check returns ErrIndexMismatch if a definition for an item bucket doesn't
+// agree with the catalog entry.
+func (info *Info) check(itemBucket []byte, d *Definition) error {
+	if info.Unique != d.Unique || !bytes.Equal(info.ItemBucket, itemBucket) {
+		return ErrIndexMismatch
+	}
+	if info.Source != "" && d.Source != "" && info.Source != d.Source {
+		return ErrIndexMismatch
+	}
+	return nil
+}
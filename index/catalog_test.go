@@ -0,0 +1,52 @@
+package index_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/toba/pbdb/engine"
+	"github.com/toba/pbdb/index"
+)
+
+func TestCatalog(t *testing.T) {
+	writer(t, func(tx engine.Tx) {
+		items := []byte("people")
+		name := &index.Definition{BucketName: index.Name("name"), Unique: true, Source: "Name"}
+		city := &index.Definition{BucketName: index.Name("city"), Source: "City"}
+
+		info, err := index.Lookup(tx, name.BucketName)
+		assert.NoError(t, err)
+		assert.Nil(t, info)
+
+		assert.NoError(t, index.Register(tx, items, name))
+		assert.NoError(t, index.Register(tx, items, city))
+		assert.NoError(t, index.Register(tx, []byte("places"), &index.Definition{BucketName: index.Name("zip")}))
+
+		// registering again is allowed if the definition matches
+		assert.NoError(t, index.Register(tx, items, name))
+		assert.NoError(t, index.Register(tx, items, &index.Definition{BucketName: name.BucketName, Unique: true}))
+
+		info, err = index.Lookup(tx, name.BucketName)
+		assert.NoError(t, err)
+		assert.Equal(t, items, info.ItemBucket)
+		assert.True(t, info.Unique)
+		assert.Equal(t, "Name", info.Source)
+		assert.False(t, info.Created.IsZero())
+
+		list, err := index.Catalog(tx, items)
+		assert.NoError(t, err)
+		assert.Len(t, list, 2)
+		assert.Equal(t, city.BucketName, list[0].Name)
+		assert.Equal(t, name.BucketName, list[1].Name)
+
+		list, err = index.Catalog(tx, nil)
+		assert.NoError(t, err)
+		assert.Len(t, list, 3)
+
+		assert.Equal(t, index.ErrIndexMismatch, index.Register(tx, items,
+			&index.Definition{BucketName: name.BucketName}))
+		assert.Equal(t, index.ErrIndexMismatch, index.Register(tx, []byte("places"), name))
+		assert.Equal(t, index.ErrIndexMismatch, index.Register(tx, items,
+			&index.Definition{BucketName: city.BucketName, Source: "Town"}))
+	})
+}
@@ -0,0 +1,16 @@
+package index
+
+import "errors"
+
+var (
+	// ErrAlreadyExists is returned when a value in a unique index is already
+	// indexed to a different item.
+	ErrAlreadyExists = errors.New("value is already indexed to another item")
+	// ErrInvalidIndexKey is returned for an empty value key.
+	ErrInvalidIndexKey = errors.New("invalid index key")
+	// ErrInvalidItemKey is returned for an item key that isn't a ULID.
+	ErrInvalidItemKey = errors.New("invalid item key")
+	// ErrIndexMismatch is returned when an index definition doesn't match
+	// the index recorded in the catalog.
+	ErrIndexMismatch = errors.New("index definition does not match the catalog")
+)
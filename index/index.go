@@ -1,77 +1,151 @@
 package index
 
-import "github.com/boltdb/bolt"
+import "github.com/toba/pbdb/engine"
 
 // Index interface defines methods required of all index types, such as
 // unique, non-unique and relation indexes.
 type Index interface {
 	Add(valueKey, itemKey []byte) error
+	Remove(valueKey, itemKey []byte) error
 	RemoveItem(itemKey []byte) error
 	RemoveValue(valueKey []byte) error
 	FirstWithValue(valueKey []byte) []byte
 	AllWithValue(valueKey []byte, opts *QueryOptions) ([][]byte, error)
 	All(opts *QueryOptions) ([][]byte, error)
 	AllInRange(min, max []byte, opts *QueryOptions) ([][]byte, error)
+	AllInPrefixRange(prefix, min, max []byte, opts *QueryOptions) ([][]byte, error)
+	ForEach(fn func(valueKey, itemKey []byte) error) error
 }
 
 // Prefix is arbitrary text added to the beginning of index names
 // to avoid conflicts with item bucket names.
 const Prefix = "_index_"
 
+// ReversePrefix is added to the beginning of an index name to name the
+// bucket mapping items back to their indexed values.
+const ReversePrefix = "_reverse_"
+
+// FormatBucket records the key format of each index created in a data file
+// by index bucket name. Non-unique indexes without a record use the legacy
+// composite key format.
+var FormatBucket = []byte("_format_")
+
+// escapedFormat is the format of indexes whose composite keys escape values.
+var escapedFormat = []byte{1}
+
 // Name creates index bucket name.
 func Name(name string) []byte { return []byte(Prefix + name) }
 
+// ReverseName creates the name of the reverse bucket for an index bucket.
+func ReverseName(indexName []byte) []byte {
+	return append([]byte(ReversePrefix), indexName...)
+}
+
 // MakeUnique creates an index that
-func MakeUnique(tx *bolt.Tx, indexName []byte) (*Unique, error) {
-	bucket, err := tx.CreateBucketIfNotExists(indexName)
+func MakeUnique(tx engine.Tx, indexName []byte) (*Unique, error) {
+	bucket, reverse, err := makeBuckets(tx, indexName)
 	if err != nil {
 		return nil, err
 	}
-	return makeUnique(bucket), nil
+	return makeUnique(bucket, reverse), nil
 }
 
 // UniqueIndex returns a pointer to the named, unique index.
-func GetUnique(tx *bolt.Tx, indexName []byte) *Unique {
+func GetUnique(tx engine.Tx, indexName []byte) *Unique {
 	bucket := tx.Bucket(indexName)
 	if bucket == nil {
 		return nil
 	}
-	return makeUnique(bucket)
+	return makeUnique(bucket, tx.Bucket(ReverseName(indexName)))
 }
 
 // MakeNonUniqueIndex creates an index allowing multiple values to reference
 // the same item key.
-func MakeNonUnique(tx *bolt.Tx, indexName []byte) (*NonUnique, error) {
-	bucket, err := tx.CreateBucketIfNotExists(indexName)
+func MakeNonUnique(tx engine.Tx, indexName []byte) (*NonUnique, error) {
+	bucket, reverse, err := makeBuckets(tx, indexName)
 	if err != nil {
 		return nil, err
 	}
-	return makeNonUnique(bucket), nil
+	return makeNonUnique(bucket, reverse, !hasFormat(tx, indexName)), nil
 }
 
 // NonUniqueIndex returns a pointer to the named, non-unique index.
-func GetNonUnique(tx *bolt.Tx, indexName []byte) *NonUnique {
+func GetNonUnique(tx engine.Tx, indexName []byte) *NonUnique {
 	bucket := tx.Bucket(indexName)
 	if bucket == nil {
 		return nil
 	}
-	return makeNonUnique(bucket)
+	return makeNonUnique(bucket, tx.Bucket(ReverseName(indexName)), !hasFormat(tx, indexName))
+}
+
+// Drop removes an index bucket, its reverse bucket and its format record.
+// There is no error if they don't exist. Badger returns engine.ErrTxnTooBig
+// for an index too large to remove in one transaction.
+func Drop(tx engine.Tx, indexName []byte) error {
+	if err := tx.DeleteBucket(indexName); err != nil {
+		return err
+	}
+	if err := tx.DeleteBucket(ReverseName(indexName)); err != nil {
+		return err
+	}
+	if formats := tx.Bucket(FormatBucket); formats != nil {
+		return formats.Delete(indexName)
+	}
+	return nil
+}
+
+// hasFormat indicates whether an index has a format record, meaning it
+// escapes composite key values.
+func hasFormat(tx engine.Tx, indexName []byte) bool {
+	formats := tx.Bucket(FormatBucket)
+	return formats != nil && formats.Get(indexName) != nil
+}
+
+// setFormat records that an index escapes composite key values.
+func setFormat(tx engine.Tx, indexName []byte) error {
+	formats, err := tx.CreateBucketIfNotExists(FormatBucket)
+	if err != nil {
+		return err
+	}
+	return formats.Put(indexName, escapedFormat)
+}
+
+// makeBuckets returns the bucket and reverse bucket of an index, creating
+// both for a new index. Indexes created before reverse buckets existed are
+// left without one, since it would be incomplete, until they're rebuilt.
+func makeBuckets(tx engine.Tx, indexName []byte) (engine.Bucket, engine.Bucket, error) {
+	if bucket := tx.Bucket(indexName); bucket != nil {
+		return bucket, tx.Bucket(ReverseName(indexName)), nil
+	}
+	bucket, err := tx.CreateBucketIfNotExists(indexName)
+	if err != nil {
+		return nil, nil, err
+	}
+	reverse, err := tx.CreateBucketIfNotExists(ReverseName(indexName))
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := setFormat(tx, indexName); err != nil {
+		return nil, nil, err
+	}
+	return bucket, reverse, nil
 }
 
-func makeUnique(b *bolt.Bucket) *Unique {
+func makeUnique(b, reverse engine.Bucket) *Unique {
 	return &Unique{
-		baseIndex: baseIndex{Bucket: b},
+		baseIndex: baseIndex{Bucket: b, Reverse: reverse},
 	}
 }
 
-func makeNonUnique(b *bolt.Bucket) *NonUnique {
+func makeNonUnique(b, reverse engine.Bucket, legacy bool) *NonUnique {
 	return &NonUnique{
-		baseIndex: baseIndex{Bucket: b},
+		baseIndex: baseIndex{Bucket: b, Reverse: reverse},
+		legacy:    legacy,
 	}
 }
 
 // MakeRelation creates an index relating one item to another.
-// func MakeRelation(tx *bolt.Tx, indexName string) (*Relation, error) {
+// func MakeRelation(tx engine.Tx, indexName string) (*Relation, error) {
 // 	bucket, err := makeIndexBucket(tx, indexName)
 // 	if err != nil {
 // 		return nil, err
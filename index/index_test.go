@@ -4,52 +4,86 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/toba/pbdb/engine"
+	"github.com/toba/pbdb/index"
 )
 
-func writer(t *testing.T, fn func() error) {
-	connect(t, func(c *client.Client) {
-		c.Writer(fn)
+func TestMakeUniqueIndex(t *testing.T) {
+	writer(t, func(tx engine.Tx) {
+		idx, err := index.MakeUnique(tx, index.Name("name"))
+		assert.NoError(t, err)
+		assert.NotNil(t, idx)
+		assert.NotNil(t, idx.Bucket)
+		assert.True(t, idx.Bucket.Writable())
 	})
 }
 
-func TestMakeUniqueIndex(t *testing.T) {
-	connect(t, func(c *client.Client) {
-		c.Writer(func() error {
-			idx, err := c.MakeUniqueIndex("name")
-			assert.NoError(t, err)
-			assert.NotNil(t, idx)
-			assert.NotNil(t, idx.Bucket)
-			assert.True(t, idx.Bucket.Writable())
+func TestMakeNonUniqueIndex(t *testing.T) {
+	writer(t, func(tx engine.Tx) {
+		idx, err := index.MakeNonUnique(tx, index.Name("name"))
+		assert.NoError(t, err)
+		assert.NotNil(t, idx)
+		assert.NotNil(t, idx.Bucket)
+		assert.True(t, idx.Bucket.Writable())
+	})
+}
 
-			return nil
-		})
+func TestGetIndex(t *testing.T) {
+	writer(t, func(tx engine.Tx) {
+		assert.Nil(t, index.GetUnique(tx, index.Name("name")))
+		assert.Nil(t, index.GetNonUnique(tx, index.Name("name")))
+
+		index.MakeUnique(tx, index.Name("name"))
+		assert.NotNil(t, index.GetUnique(tx, index.Name("name")))
 	})
 }
 
-func TestMakeNonUniqueIndex(t *testing.T) {
-	connect(t, func(c *client.Client) {
-		c.Writer(func() error {
-			idx, err := c.MakeNonUniqueIndex("name")
-			assert.NoError(t, err)
-			assert.NotNil(t, idx)
-			assert.NotNil(t, idx.Bucket)
-			assert.True(t, idx.Bucket.Writable())
+func TestReverseBucket(t *testing.T) {
+	writer(t, func(tx engine.Tx) {
+		idx, err := index.MakeNonUnique(tx, index.Name("name"))
+		assert.NoError(t, err)
+		assert.NotNil(t, idx.Reverse)
+		assert.NotNil(t, tx.Bucket(index.ReverseName(index.Name("name"))))
+
+		assert.NoError(t, idx.Add(values[0], items[0]))
+		assert.NoError(t, idx.Add(values[1], items[0]))
+		assert.NoError(t, idx.Add(values[1], items[1]))
 
+		assert.NoError(t, idx.RemoveItem(items[0]))
+		matches, _ := idx.AllWithValue(values[1], nil)
+		assert.Equal(t, [][]byte{items[1]}, matches)
+		assert.Nil(t, idx.FirstWithValue(values[0]))
+
+		count := 0
+		idx.Reverse.ForEach(func(k, v []byte) error {
+			count++
+			assert.Equal(t, values[1], v)
 			return nil
 		})
+		assert.Equal(t, 1, count)
+
+		assert.NoError(t, idx.RemoveValue(values[1]))
+		k, _ := idx.Reverse.Cursor().First()
+		assert.Nil(t, k)
+
+		assert.NoError(t, index.Drop(tx, index.Name("name")))
+		assert.Nil(t, index.GetNonUnique(tx, index.Name("name")))
+		assert.Nil(t, tx.Bucket(index.ReverseName(index.Name("name"))))
 	})
 }
 
-func TestMakeRelation(t *testing.T) {
-	connect(t, func(c *client.Client) {
-		c.Writer(func() error {
-			idx, err := c.MakeRelation("name")
-			assert.NoError(t, err)
-			assert.NotNil(t, idx)
-			assert.NotNil(t, idx.Bucket)
-			assert.True(t, idx.Bucket.Writable())
+func TestWithoutReverseBucket(t *testing.T) {
+	writer(t, func(tx engine.Tx) {
+		// indexes created before reverse buckets are still scanned
+		_, err := tx.CreateBucketIfNotExists(index.Name("name"))
+		assert.NoError(t, err)
 
-			return nil
-		})
+		idx, err := index.MakeUnique(tx, index.Name("name"))
+		assert.NoError(t, err)
+		assert.Nil(t, idx.Reverse)
+
+		assert.NoError(t, idx.Add(values[0], items[0]))
+		assert.NoError(t, idx.RemoveItem(items[0]))
+		assert.Nil(t, idx.FirstWithValue(values[0]))
 	})
 }
@@ -1,15 +1,21 @@
 package index
 
+import "bytes"
+
 type (
 	// Definition of an indexed value.
 	Definition struct {
 		// BucketName for the index.
 		BucketName []byte
-		// Value to be indexed.
+		// Value to be indexed. A composite value joins several fields
+		// encoded with the order package.
 		Value []byte
 		// Unique indicates a unique index should be used, otherwise a non-
 		// unique index is used.
 		Unique bool
+		// Source optionally names the field or extractor the value comes
+		// from. It is recorded in the catalog but not compared by Has.
+		Source string
 	}
 
 	// Map matches values to be indexed and the index type with an index name.
@@ -29,6 +35,7 @@ func Define(value, name []byte, unique bool) Map {
 	}
 }
 
+// Add appends an index definition to the map.
 func (m Map) Add(value, name []byte, unique bool) Map {
 	m.Definitions = append(m.Definitions, &Definition{
 		BucketName: name,
@@ -37,3 +44,46 @@ func (m Map) Add(value, name []byte, unique bool) Map {
 	})
 	return m
 }
+
+// DefineComposite creates a definition indexing several fields together. Each
+// field must be encoded with the order package so fields sort in turn and
+// can be matched with AllInPrefixRange.
+func DefineComposite(name []byte, unique bool, fields ...[]byte) Map {
+	return Map{}.AddComposite(name, unique, fields...)
+}
+
+// AddComposite appends a definition indexing several fields together, as for
+// DefineComposite.
+func (m Map) AddComposite(name []byte, unique bool, fields ...[]byte) Map {
+	return m.Add(bytes.Join(fields, nil), name, unique)
+}
+
+// Diff compares the map of a previously saved value with the map of its
+// replacement, returning the definitions that must be added and those that
+// must be removed.
+func (m Map) Diff(next Map) (added, removed Map) {
+	for _, d := range next.Definitions {
+		if !m.Has(d) {
+			added.Definitions = append(added.Definitions, d)
+		}
+	}
+	for _, d := range m.Definitions {
+		if !next.Has(d) {
+			removed.Definitions = append(removed.Definitions, d)
+		}
+	}
+	return added, removed
+}
+
+// Has indicates whether the map contains a definition with the same index
+// name, value and type.
+func (m Map) Has(d *Definition) bool {
+	for _, other := range m.Definitions {
+		if other.Unique == d.Unique &&
+			bytes.Equal(other.BucketName, d.BucketName) &&
+			bytes.Equal(other.Value, d.Value) {
+			return true
+		}
+	}
+	return false
+}
@@ -1 +1,45 @@
 package index_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/toba/pbdb/index"
+)
+
+func TestMapDiff(t *testing.T) {
+	first := index.Name("first")
+	last := index.Name("last")
+
+	previous := index.Define([]byte("Jane"), first, false).Add([]byte("Doe"), last, true)
+	next := index.Define([]byte("Jane"), first, false).Add([]byte("Roe"), last, true)
+
+	added, removed := previous.Diff(next)
+	assert.Len(t, added.Definitions, 1)
+	assert.Equal(t, []byte("Roe"), added.Definitions[0].Value)
+	assert.Len(t, removed.Definitions, 1)
+	assert.Equal(t, []byte("Doe"), removed.Definitions[0].Value)
+
+	// nothing to change for identical maps
+	added, removed = next.Diff(next)
+	assert.Nil(t, added.Definitions)
+	assert.Nil(t, removed.Definitions)
+
+	// everything is added for a new value
+	added, removed = index.Map{}.Diff(next)
+	assert.Len(t, added.Definitions, 2)
+	assert.Nil(t, removed.Definitions)
+}
+
+func TestMapComposite(t *testing.T) {
+	name := index.Name("fullName")
+	m := index.DefineComposite(name, false, []byte("Doe\x00\x01"), []byte("Jane\x00\x01"))
+
+	assert.Len(t, m.Definitions, 1)
+	assert.Equal(t, []byte("Doe\x00\x01Jane\x00\x01"), m.Definitions[0].Value)
+	assert.Equal(t, name, m.Definitions[0].BucketName)
+
+	m = m.AddComposite(index.Name("place"), true, []byte("US"))
+	assert.Len(t, m.Definitions, 2)
+	assert.True(t, m.Definitions[1].Unique)
+}
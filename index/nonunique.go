@@ -3,8 +3,8 @@ package index
 import (
 	"bytes"
 
+	"github.com/toba/pbdb/engine"
 	"github.com/toba/pbdb/key"
-	"toba.io/lib/oops"
 )
 
 // NonUnique is an index that matches non-unique item values to their item key,
@@ -15,75 +15,268 @@ import (
 //    value2_item1 -> item1
 //    value2_item3 -> item3
 //    ...
-type NonUnique struct{ baseIndex }
+type NonUnique struct {
+	baseIndex
+	// legacy indicates composite keys are the raw value, separator and item
+	// key rather than the escaped value and item key.
+	legacy bool
+}
 
 // Add a value indexed to its item key. The bucket key is a composite of the value
 // and item keys to allow multiple values per item.
 //
-// The composite key will lead to erroneous matches if it plus the separator has
-// the same initial bytes as a longer value key.
+// The value is escaped within the composite key so any bytes may be indexed
+// and keys sort in the order of their values. Legacy indexes, created before
+// values were escaped, will lead to erroneous matches if a value contains the
+// separator or has the same initial bytes as a longer value, until migrated
+// with MigrateNonUnique.
 func (idx *NonUnique) Add(valueKey, itemKey []byte) error {
 	if err := validKeys(valueKey, itemKey); err != nil {
 		return err
 	}
-	return idx.add(makeCompositeKey(valueKey, itemKey), itemKey)
+	if err := idx.add(idx.compositeKey(valueKey, itemKey), itemKey); err != nil {
+		return err
+	}
+	return idx.addReverse(valueKey, itemKey)
+}
+
+// Remove deletes the single entry matching a value and item key.
+func (idx *NonUnique) Remove(valueKey, itemKey []byte) error {
+	if err := validKeys(valueKey, itemKey); err != nil {
+		return err
+	}
+	if err := idx.Bucket.Delete(idx.compositeKey(valueKey, itemKey)); err != nil {
+		return err
+	}
+	return idx.removeReverse(valueKey, itemKey)
+}
+
+// ForEach executes a function for every value and item key pair, stopping at
+// the first error. The value is decoded from the composite key.
+func (idx *NonUnique) ForEach(fn func(valueKey, itemKey []byte) error) error {
+	return idx.Bucket.ForEach(func(k, itemKey []byte) error {
+		valueKey, err := idx.valueOf(k, itemKey)
+		if err != nil {
+			return err
+		}
+		return fn(valueKey, itemKey)
+	})
 }
 
 // RemoveValue deletes all bucket items with a key prefixed by a value.
 func (idx *NonUnique) RemoveValue(valueKey []byte) error {
 	if key.IsEmpty(valueKey) {
-		return oops.InvalidIndexKey
+		return ErrInvalidIndexKey
 	}
-	keys := idx.keysWithPrefix(valueKey)
+	keys := idx.keysWithPrefix(idx.prefix(valueKey))
 
 	if keys == nil {
 		return nil
 	}
 
 	for _, k := range keys {
+		itemKey := append([]byte(nil), idx.Bucket.Get(k)...)
+
 		if err := idx.Bucket.Delete(k); err != nil {
 			return err
 		}
+		if err := idx.removeReverse(valueKey, itemKey); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-// RemoveItem removes an item key from all entries of which it was part.
+// RemoveItem removes an item key from all entries of which it was part. The
+// item's values are read from the reverse bucket or, if the index has none,
+// found by iterating over all bucket contents.
 func (idx *NonUnique) RemoveItem(itemKey []byte) error {
-	return idx.removeItem(itemKey)
+	return idx.removeValues(itemKey, idx.Remove)
 }
 
 // FirstWithValue returns the first item key indexed to a value.
 func (idx *NonUnique) FirstWithValue(valueKey []byte) []byte {
 	c := idx.Bucket.Cursor()
-	k, itemKey := c.Seek(firstPrefix(valueKey))
+	prefix := idx.prefix(valueKey)
+	k, itemKey := c.Seek(prefix)
 	// if seek does not find a match it stops at the next key
 	// (the first one lexically higher than the valueKey)
-	if bytes.HasPrefix(k, makePrefix(valueKey)) {
+	if bytes.HasPrefix(k, prefix) {
 		return itemKey
 	}
 	return nil
 }
 
-// AllWithValue returns all item keys indexed to a value.
+// AllWithValue returns all item keys indexed to a value, ordered by item
+// key.
 func (idx *NonUnique) AllWithValue(valueKey []byte, opts *QueryOptions) ([][]byte, error) {
-	return idx.itemsWithValuePrefix(valueKey), nil
+	return idx.page(idx.firstKey(valueKey), idx.lastKey(valueKey), opts, false), nil
 }
 
-// All returns all unique item keys in the index.
+// All returns all unique item keys in the index, ordered by the first value
+// each is indexed to.
 func (idx *NonUnique) All(opts *QueryOptions) ([][]byte, error) {
-	items, err := allValues(idx.Bucket)
-	if err != nil {
-		return nil, err
-	}
-	return unique(items), nil
+	return idx.page(nil, nil, opts, true), nil
 }
 
-// AllInRange returns the unique item keys corresponding to a range of values.
+// AllInRange returns the unique item keys corresponding to a range of values,
+// ordered by the first value in the range each is indexed to. A nil min or
+// max leaves that end of the range open.
 func (idx *NonUnique) AllInRange(min, max []byte, opts *QueryOptions) ([][]byte, error) {
-	items, err := idx.allInRange(firstPrefix(min), lastPrefix(max), valueMap)
+	var first, last []byte
+	if min != nil {
+		first = idx.firstKey(min)
+	}
+	if max != nil {
+		last = idx.lastKey(max)
+	}
+	return idx.page(first, last, opts, true), nil
+}
+
+// AllInPrefixRange returns the unique item keys for values beginning with a
+// prefix whose remaining bytes begin between min and max, inclusive, ordered
+// by the first value in the range each is indexed to. A nil min or max leaves
+// that end of the range open.
+//
+// For composite values this matches equality on the leading fields encoded
+// in the prefix and a range on the next field, whatever fields follow it.
+func (idx *NonUnique) AllInPrefixRange(prefix, min, max []byte, opts *QueryOptions) ([][]byte, error) {
+	r := keyRange{
+		min:    idx.valuePrefix(join(prefix, min)),
+		max:    idx.valuePrefix(join(prefix, max)),
+		prefix: true,
+	}
+	return idx.pageRange(r, opts, true), nil
+}
+
+// prefix returns the beginning of every composite key for a value.
+func (idx *NonUnique) prefix(valueKey []byte) []byte {
+	if idx.legacy {
+		return makePrefix(valueKey)
+	}
+	return escapeValue(valueKey)
+}
+
+// valuePrefix returns the beginning of every composite key for values
+// beginning with the given bytes. The escaped value is used without its
+// terminator.
+func (idx *NonUnique) valuePrefix(valueKey []byte) []byte {
+	if idx.legacy {
+		return valueKey
+	}
+	escaped := escapeValue(valueKey)
+	return escaped[:len(escaped)-2]
+}
+
+// compositeKey returns the bucket key for a value and item key pair.
+func (idx *NonUnique) compositeKey(valueKey, itemKey []byte) []byte {
+	return append(idx.prefix(valueKey), itemKey...)
+}
+
+// firstKey returns the lowest possible composite key for a value.
+func (idx *NonUnique) firstKey(valueKey []byte) []byte {
+	return append(idx.prefix(valueKey), key.Zero...)
+}
+
+// lastKey returns the highest possible composite key for a value.
+func (idx *NonUnique) lastKey(valueKey []byte) []byte {
+	return append(idx.prefix(valueKey), key.Max...)
+}
+
+// valueOf decodes the value from a composite key.
+func (idx *NonUnique) valueOf(k, itemKey []byte) ([]byte, error) {
+	if idx.legacy {
+		end := len(k) - len(itemKey) - 1
+		if end < 0 {
+			return nil, ErrInvalidIndexKey
+		}
+		return k[:end], nil
+	}
+	if len(k) < len(itemKey) {
+		return nil, ErrInvalidIndexKey
+	}
+	return unescapeValue(k[:len(k)-len(itemKey)])
+}
+
+// MigrateNonUnique rewrites the composite keys of a legacy non-unique index
+// with escaped values, returning the number of entries rewritten. There is
+// nothing to do for an index that doesn't exist or was already migrated.
+func MigrateNonUnique(tx engine.Tx, indexName []byte) (int, error) {
+	idx := GetNonUnique(tx, indexName)
+	if idx == nil || !idx.legacy {
+		return 0, nil
+	}
+	type entry struct{ k, valueKey, itemKey []byte }
+	var entries []entry
+
+	err := idx.Bucket.ForEach(func(k, itemKey []byte) error {
+		valueKey, err := idx.valueOf(k, itemKey)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry{
+			k:        append([]byte(nil), k...),
+			valueKey: append([]byte(nil), valueKey...),
+			itemKey:  append([]byte(nil), itemKey...),
+		})
+		return nil
+	})
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	return unique(items), nil
+	for _, e := range entries {
+		if err := idx.Bucket.Delete(e.k); err != nil {
+			return 0, err
+		}
+	}
+	for _, e := range entries {
+		k := append(escapeValue(e.valueKey), e.itemKey...)
+		if err := idx.Bucket.Put(k, e.itemKey); err != nil {
+			return 0, err
+		}
+	}
+	return len(entries), setFormat(tx, indexName)
+}
+
+// LegacyNonUnique returns the names of the non-unique indexes in a data file
+// that still have legacy composite keys. A catalog index is included unless
+// it's unique. Indexes created before the catalog are recognized by their
+// keys, each being a value, the separator and the item key it's indexed to,
+// so an empty one isn't found.
+func LegacyNonUnique(tx engine.Tx) ([][]byte, error) {
+	var names [][]byte
+
+	err := tx.ForEachBucket(func(name []byte) error {
+		if !bytes.HasPrefix(name, []byte(Prefix)) || hasFormat(tx, name) {
+			return nil
+		}
+		info, err := Lookup(tx, name)
+		if err != nil {
+			return err
+		}
+		if info != nil && info.Unique {
+			return nil
+		}
+		if info == nil && !hasLegacyKeys(tx.Bucket(name)) {
+			return nil
+		}
+		names = append(names, append([]byte(nil), name...))
+		return nil
+	})
+	return names, err
+}
+
+// hasLegacyKeys indicates whether an index bucket has keys and every one is a
+// legacy composite key. A unique index key is the value alone.
+func hasLegacyKeys(bucket engine.Bucket) bool {
+	count := 0
+	err := bucket.ForEach(func(k, itemKey []byte) error {
+		end := len(k) - len(itemKey) - 1
+		if len(itemKey) == 0 || end < 1 || k[end] != keySeparator || !bytes.Equal(k[end+1:], itemKey) {
+			return ErrInvalidIndexKey
+		}
+		count++
+		return nil
+	})
+	return err == nil && count > 0
 }
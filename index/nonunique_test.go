@@ -1,11 +1,13 @@
 package index_test
 
 import (
-	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/toba/pbdb/engine"
 	"github.com/toba/pbdb/index"
+	"github.com/toba/pbdb/key"
+	"github.com/toba/pbdb/order"
 )
 
 // repeats maps value keys to multiple item keys. The index of the outer
@@ -40,22 +42,14 @@ func addRepeatItems(idx *index.NonUnique) error {
 
 // withNonUnique creates test index with values that are cleaned up after use.
 func withNonUnique(t *testing.T, fn func(idx *index.NonUnique)) {
-	dir, c, err := connect()
-	assert.NoError(t, err)
-
-	defer os.RemoveAll(dir)
-	defer c.Close()
-
-	c.Writer(func() error {
-		idx, err := c.MakeNonUniqueIndex("test")
+	writer(t, func(tx engine.Tx) {
+		idx, err := index.MakeNonUnique(tx, index.Name("test"))
 		assert.NoError(t, err)
 
 		err = addRepeatItems(idx)
 		assert.NoError(t, err)
 
 		fn(idx)
-
-		return nil
 	})
 }
 
@@ -94,6 +88,22 @@ func TestNonUniqueRemoveValue(t *testing.T) {
 	})
 }
 
+func TestNonUniqueRemove(t *testing.T) {
+	withNonUnique(t, func(idx *index.NonUnique) {
+		err := idx.Remove(values[1], items[2])
+		assert.NoError(t, err)
+
+		// only the one entry should be removed
+		matches, err := idx.AllWithValue(values[1], nil)
+		assert.NoError(t, err)
+		assert.Len(t, matches, 3)
+		assert.False(t, key.ListContains(matches, items[2]))
+
+		// item should still be indexed to its other value
+		assert.Equal(t, items[2], idx.FirstWithValue(values[2]))
+	})
+}
+
 func TestNonUniqueRemoveItem(t *testing.T) {
 	withNonUnique(t, func(idx *index.NonUnique) {
 		// initially four items indexed to value 1
@@ -165,5 +175,212 @@ func TestNonUniqueAllInRange(t *testing.T) {
 		matches, err = idx.AllInRange(values[2], values[5], nil)
 		assert.NoError(t, err)
 		assert.Len(t, matches, 5)
+
+		// nil leaves either end of the range open
+		matches, err = idx.AllInRange(values[8], nil, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{items[8], items[9]}, matches)
+
+		matches, err = idx.AllInRange(values[8], nil, &index.QueryOptions{Reverse: true})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{items[9], items[8]}, matches)
+
+		matches, err = idx.AllInRange(nil, values[1], nil)
+		assert.NoError(t, err)
+		assert.Equal(t, items[:5], matches)
+
+		matches, err = idx.AllInRange(nil, nil, nil)
+		assert.NoError(t, err)
+		assert.Len(t, matches, len(items))
+	})
+}
+
+func TestNonUniqueForEach(t *testing.T) {
+	withNonUnique(t, func(idx *index.NonUnique) {
+		found := make(map[string]int)
+		err := idx.ForEach(func(valueKey, itemKey []byte) error {
+			found[string(valueKey)]++
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Len(t, found, 10)
+		assert.Equal(t, 4, found[string(values[1])])
+		assert.Equal(t, 3, found[string(values[3])])
+	})
+}
+
+func TestNonUniqueQueryOptions(t *testing.T) {
+	withNonUnique(t, func(idx *index.NonUnique) {
+		// value[1] = item[1,2,3,4]
+		matches, err := idx.AllWithValue(values[1], &index.QueryOptions{Skip: 1, Limit: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{items[2], items[3]}, matches)
+
+		matches, err = idx.AllWithValue(values[1], &index.QueryOptions{Limit: 3, Reverse: true})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{items[4], items[3], items[2]}, matches)
+
+		// distinct items are paged: 0, 1, 2, 3, 4 then 6
+		matches, err = idx.All(&index.QueryOptions{Skip: 4, Limit: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{items[4], items[6]}, matches)
+
+		matches, err = idx.All(&index.QueryOptions{Limit: 2, Reverse: true})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{items[9], items[8]}, matches)
+
+		// value[3] = item[3,4,6] read in reverse before value[2] = item[2]
+		matches, err = idx.AllInRange(values[2], values[3], &index.QueryOptions{Reverse: true})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{items[6], items[4], items[3], items[2]}, matches)
+	})
+}
+
+func TestNonUniqueBinaryValues(t *testing.T) {
+	writer(t, func(tx engine.Tx) {
+		idx, err := index.MakeNonUnique(tx, index.Name("binary"))
+		assert.NoError(t, err)
+
+		binary := [][]byte{
+			[]byte("ab"),
+			{'a', 'b', 0x00},
+			{'a', 'b', 0xFF},
+			[]byte("abc"),
+			{'a', 'b', 0x00, 0x01},
+		}
+		for i, v := range binary {
+			assert.NoError(t, idx.Add(v, items[i]))
+		}
+		for i, v := range binary {
+			matches, err := idx.AllWithValue(v, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, [][]byte{items[i]}, matches, "value %x", v)
+		}
+
+		// values sort in byte order
+		matches, err := idx.AllInRange([]byte("ab"), []byte("abc"), nil)
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{items[0], items[1], items[4], items[3]}, matches)
+
+		found := make(map[string][]byte)
+		err = idx.ForEach(func(valueKey, itemKey []byte) error {
+			found[string(valueKey)] = itemKey
+			return nil
+		})
+		assert.NoError(t, err)
+		for i, v := range binary {
+			assert.Equal(t, items[i], found[string(v)])
+		}
+	})
+}
+
+func TestMigrateNonUnique(t *testing.T) {
+	writer(t, func(tx engine.Tx) {
+		name := index.Name("legacy")
+		// a bucket without a format record has legacy keys
+		_, err := tx.CreateBucketIfNotExists(name)
+		assert.NoError(t, err)
+		idx, err := index.MakeNonUnique(tx, name)
+		assert.NoError(t, err)
+
+		assert.NoError(t, idx.Add([]byte("a"), items[0]))
+		assert.NoError(t, idx.Add([]byte{'a', 0xFF}, items[1]))
+
+		// the longer value is mistaken for the shorter
+		matches, err := idx.AllWithValue([]byte("a"), nil)
+		assert.NoError(t, err)
+		assert.Len(t, matches, 2)
+
+		count, err := index.MigrateNonUnique(tx, name)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, count)
+
+		idx = index.GetNonUnique(tx, name)
+		matches, err = idx.AllWithValue([]byte("a"), nil)
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{items[0]}, matches)
+		matches, err = idx.AllWithValue([]byte{'a', 0xFF}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{items[1]}, matches)
+
+		// already migrated
+		count, err = index.MigrateNonUnique(tx, name)
+		assert.NoError(t, err)
+		assert.Zero(t, count)
+	})
+}
+
+func TestLegacyNonUnique(t *testing.T) {
+	writer(t, func(tx engine.Tx) {
+		legacy := index.Name("legacy")
+		_, err := tx.CreateBucketIfNotExists(legacy)
+		assert.NoError(t, err)
+		idx, err := index.MakeNonUnique(tx, legacy)
+		assert.NoError(t, err)
+		assert.NoError(t, idx.Add([]byte("a"), items[0]))
+		assert.NoError(t, idx.Add([]byte("a"), items[1]))
+
+		// empty and escaped indexes aren't migrated
+		_, err = tx.CreateBucketIfNotExists(index.Name("empty"))
+		assert.NoError(t, err)
+		escaped, err := index.MakeNonUnique(tx, index.Name("escaped"))
+		assert.NoError(t, err)
+		assert.NoError(t, escaped.Add([]byte("a"), items[0]))
+
+		// nor are unique indexes, whether or not they're in the catalog
+		unique, err := index.MakeUnique(tx, index.Name("unique"))
+		assert.NoError(t, err)
+		assert.NoError(t, addItems(unique))
+		cataloged := &index.Definition{BucketName: index.Name("cataloged"), Unique: true}
+		assert.NoError(t, index.Register(tx, []byte("items"), cataloged))
+		unique, err = index.MakeUnique(tx, cataloged.BucketName)
+		assert.NoError(t, err)
+		assert.NoError(t, addItems(unique))
+
+		names, err := index.LegacyNonUnique(tx)
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{legacy}, names)
+
+		_, err = index.MigrateNonUnique(tx, legacy)
+		assert.NoError(t, err)
+		names, err = index.LegacyNonUnique(tx)
+		assert.NoError(t, err)
+		assert.Empty(t, names)
+	})
+}
+
+func TestNonUniquePrefixRange(t *testing.T) {
+	writer(t, func(tx engine.Tx) {
+		idx, err := index.MakeNonUnique(tx, index.Name("address"))
+		assert.NoError(t, err)
+		assert.NoError(t, addAddresses(idx))
+		us := order.String("US")
+
+		// equality on the country alone doesn't match a longer country
+		matches, err := idx.AllInPrefixRange(us, nil, nil, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, items[1:5], matches)
+
+		// the range includes every postal code beginning with max
+		matches, err = idx.AllInPrefixRange(us, order.String("10001"), order.String("10001"), nil)
+		assert.NoError(t, err)
+		assert.Equal(t, items[2:3], matches)
+
+		matches, err = idx.AllInPrefixRange(us, order.String("1"), order.String("99999"), nil)
+		assert.NoError(t, err)
+		assert.Equal(t, items[2:5], matches)
+
+		matches, err = idx.AllInPrefixRange(us, nil, order.String("10001-1234"), &index.QueryOptions{Reverse: true, Limit: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{items[3], items[2]}, matches)
+
+		matches, err = idx.AllInPrefixRange(order.String("MX"), nil, nil, nil)
+		assert.NoError(t, err)
+		assert.Empty(t, matches)
+
+		// an empty prefix ranges over the first field
+		matches, err = idx.AllInPrefixRange(nil, order.String("US"), order.String("USA"), &index.QueryOptions{Reverse: true})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{items[5], items[4], items[3], items[2], items[1]}, matches)
 	})
 }
@@ -2,8 +2,12 @@ package index
 
 // QueryOptions are used to customize queries.
 type QueryOptions struct {
-	Limit   int
-	Skip    int
+	// Limit is the most item keys to return. Zero or less means no limit.
+	Limit int
+	// Skip is the number of item keys to pass over before returning any.
+	Skip int
+	// Reverse returns item keys in descending rather than ascending order
+	// of index keys.
 	Reverse bool
 }
 
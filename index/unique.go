@@ -1,5 +1,7 @@
 package index
 
+import "bytes"
+
 // Unique is an index of non-repeating values stored in their own bucket
 // that reference standard item keys in a separate bucket.
 //
@@ -11,18 +13,48 @@ type Unique struct{ baseIndex }
 
 // Add a value and its target item key to the index.
 func (idx *Unique) Add(valueKey, itemKey []byte) error {
-	return idx.add(valueKey, itemKey)
+	if err := idx.add(valueKey, itemKey); err != nil {
+		return err
+	}
+	return idx.addReverse(valueKey, itemKey)
+}
+
+// Remove deletes a value from the index if it references the item key.
+func (idx *Unique) Remove(valueKey, itemKey []byte) error {
+	if !bytes.Equal(idx.Bucket.Get(valueKey), itemKey) {
+		return nil
+	}
+	if err := idx.Bucket.Delete(valueKey); err != nil {
+		return err
+	}
+	return idx.removeReverse(valueKey, itemKey)
 }
 
-// RemoveItem removes an item key from the unique index by iterating over all
-// bucket contents until itemKey is found.
+// RemoveItem removes an item key from the unique index. The item's values
+// are read from the reverse bucket or, if the index has none, found by
+// iterating over all bucket contents.
 func (idx *Unique) RemoveItem(itemKey []byte) error {
-	return idx.removeItem(itemKey)
+	return idx.removeValues(itemKey, idx.Remove)
+}
+
+// ForEach executes a function for every value and the item key it's indexed
+// to, stopping at the first error.
+func (idx *Unique) ForEach(fn func(valueKey, itemKey []byte) error) error {
+	return idx.Bucket.ForEach(fn)
 }
 
 // RemoveValue removes a value key from the index.
 func (idx *Unique) RemoveValue(valueKey []byte) error {
-	return idx.Bucket.Delete(valueKey)
+	itemKey := idx.Bucket.Get(valueKey)
+	if itemKey == nil {
+		return nil
+	}
+	itemKey = append([]byte(nil), itemKey...)
+
+	if err := idx.Bucket.Delete(valueKey); err != nil {
+		return err
+	}
+	return idx.removeReverse(valueKey, itemKey)
 }
 
 // FirstWithValue returns the first item key matched to an indexed value. For
@@ -34,15 +66,31 @@ func (idx *Unique) FirstWithValue(valueKey []byte) []byte {
 // AllWithValue returns the item keys referenced by a value key. For
 // a unique index, this will always be zero or one items.
 func (idx *Unique) AllWithValue(valueKey []byte, opts *QueryOptions) ([][]byte, error) {
-	return [][]byte{idx.Bucket.Get(valueKey)}, nil
+	itemKey := idx.Bucket.Get(valueKey)
+	if itemKey == nil || (opts != nil && opts.Skip > 0) {
+		return nil, nil
+	}
+	return [][]byte{itemKey}, nil
 }
 
-// All returns all item keys in the index.
+// All returns all item keys in the index, ordered by value.
 func (idx *Unique) All(opts *QueryOptions) ([][]byte, error) {
-	return allValues(idx.Bucket)
+	return idx.page(nil, nil, opts, false), nil
 }
 
-// AllInRange returns the item keys corresponding to a range of values.
+// AllInRange returns the item keys corresponding to a range of values,
+// ordered by value. A nil min or max leaves that end of the range open.
 func (idx *Unique) AllInRange(min, max []byte, opts *QueryOptions) ([][]byte, error) {
-	return idx.allInRange(min, max, valueMap)
+	return idx.page(min, max, opts, false), nil
+}
+
+// AllInPrefixRange returns the item keys for values beginning with a prefix
+// whose remaining bytes begin between min and max, inclusive, ordered by
+// value. A nil min or max leaves that end of the range open.
+//
+// For composite values this matches equality on the leading fields encoded
+// in the prefix and a range on the next field, whatever fields follow it.
+func (idx *Unique) AllInPrefixRange(prefix, min, max []byte, opts *QueryOptions) ([][]byte, error) {
+	r := keyRange{min: join(prefix, min), max: join(prefix, max), prefix: true}
+	return idx.pageRange(r, opts, false), nil
 }
@@ -1,33 +1,25 @@
 package index_test
 
 import (
-	"os"
 	"testing"
 
+	"github.com/toba/pbdb/engine"
 	"github.com/toba/pbdb/index"
-	"toba.io/lib/oops"
+	"github.com/toba/pbdb/order"
 
 	"github.com/stretchr/testify/assert"
 )
 
 // withUnique creates test index with values that are removed after use.
 func withUnique(t *testing.T, fn func(idx *index.Unique)) {
-	dir, c, err := connect()
-	assert.NoError(t, err)
-
-	defer os.RemoveAll(dir)
-	defer c.Close()
-
-	c.Writer(func() error {
-		idx, err := c.MakeUniqueIndex("test")
+	writer(t, func(tx engine.Tx) {
+		idx, err := index.MakeUnique(tx, index.Name("test"))
 		assert.NoError(t, err)
 
 		err = addItems(idx)
 		assert.NoError(t, err)
 
 		fn(idx)
-
-		return nil
 	})
 }
 
@@ -39,7 +31,7 @@ func TestUniqueAdd(t *testing.T) {
 
 		// replacing existing index should return error
 		err = idx.Add(values[3], items[5])
-		assert.Error(t, oops.AlreadyExists)
+		assert.Equal(t, index.ErrAlreadyExists, err)
 	})
 }
 
@@ -68,6 +60,19 @@ func TestUniqueRemoveValue(t *testing.T) {
 	})
 }
 
+func TestUniqueRemove(t *testing.T) {
+	withUnique(t, func(idx *index.Unique) {
+		// value indexed to a different item should be unchanged
+		err := idx.Remove(values[3], items[4])
+		assert.NoError(t, err)
+		assert.Equal(t, items[3], idx.FirstWithValue(values[3]))
+
+		err = idx.Remove(values[3], items[3])
+		assert.NoError(t, err)
+		assert.Nil(t, idx.FirstWithValue(values[3]))
+	})
+}
+
 func TestUniqueRemoveItem(t *testing.T) {
 	withUnique(t, func(idx *index.Unique) {
 		err := idx.RemoveItem(items[3])
@@ -109,5 +114,102 @@ func TestUniqueAllInRange(t *testing.T) {
 		matches, err = idx.AllInRange(values[2], values[8], nil)
 		assert.NoError(t, err)
 		assert.Len(t, matches, 7)
+
+		// nil leaves either end of the range open
+		matches, err = idx.AllInRange(values[8], nil, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{items[8], items[9]}, matches)
+
+		matches, err = idx.AllInRange(nil, values[1], nil)
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{items[0], items[1]}, matches)
+
+		matches, err = idx.AllInRange(nil, nil, &index.QueryOptions{Reverse: true})
+		assert.NoError(t, err)
+		assert.Len(t, matches, len(items))
+		assert.Equal(t, items[9], matches[0])
+	})
+}
+
+func TestUniqueForEach(t *testing.T) {
+	withUnique(t, func(idx *index.Unique) {
+		count := 0
+		err := idx.ForEach(func(valueKey, itemKey []byte) error {
+			assert.Equal(t, values[count], valueKey)
+			assert.Equal(t, items[count], itemKey)
+			count++
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 10, count)
+	})
+}
+
+func TestUniqueQueryOptions(t *testing.T) {
+	withUnique(t, func(idx *index.Unique) {
+		matches, err := idx.All(&index.QueryOptions{Skip: 2, Limit: 3})
+		assert.NoError(t, err)
+		assert.Equal(t, items[2:5], matches)
+
+		matches, err = idx.All(&index.QueryOptions{Limit: 2, Reverse: true})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{items[9], items[8]}, matches)
+
+		matches, err = idx.AllInRange(values[2], values[6], &index.QueryOptions{Skip: 1, Reverse: true})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{items[5], items[4], items[3], items[2]}, matches)
+
+		// range ends between keys
+		matches, err = idx.AllInRange(values[2], []byte("ee"), &index.QueryOptions{Reverse: true})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{items[3], items[2]}, matches)
+
+		matches, err = idx.AllInRange(values[8], []byte("zz"), &index.QueryOptions{Reverse: true})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{items[9], items[8]}, matches)
+
+		matches, err = idx.AllWithValue(values[3], &index.QueryOptions{Skip: 1})
+		assert.NoError(t, err)
+		assert.Nil(t, matches)
+
+		matches, err = idx.AllWithValue([]byte("missing"), nil)
+		assert.NoError(t, err)
+		assert.Nil(t, matches)
+	})
+}
+
+func TestUniquePrefixRange(t *testing.T) {
+	writer(t, func(tx engine.Tx) {
+		idx, err := index.MakeUnique(tx, index.Name("address"))
+		assert.NoError(t, err)
+		assert.NoError(t, addAddresses(idx))
+		us := order.String("US")
+
+		// equality on the country alone doesn't match a longer country
+		matches, err := idx.AllInPrefixRange(us, nil, nil, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, items[1:5], matches)
+
+		// the range includes every postal code beginning with max
+		matches, err = idx.AllInPrefixRange(us, order.String("10001"), order.String("10001"), nil)
+		assert.NoError(t, err)
+		assert.Equal(t, items[2:3], matches)
+
+		matches, err = idx.AllInPrefixRange(us, order.String("1"), order.String("99999"), nil)
+		assert.NoError(t, err)
+		assert.Equal(t, items[2:5], matches)
+
+		matches, err = idx.AllInPrefixRange(us, nil, order.String("10001-1234"), &index.QueryOptions{Reverse: true, Limit: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{items[3], items[2]}, matches)
+
+		matches, err = idx.AllInPrefixRange(order.String("MX"), nil, nil, nil)
+		assert.NoError(t, err)
+		assert.Empty(t, matches)
+
+		// an empty prefix ranges over the first field
+		matches, err = idx.AllInPrefixRange(nil, order.String("US"), order.String("USA"), &index.QueryOptions{Reverse: true})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{items[5], items[4], items[3], items[2], items[1]}, matches)
 	})
 }
@@ -1,14 +1,14 @@
 package index
 
 import (
-	"github.com/boltdb/bolt"
+	"github.com/toba/pbdb/engine"
 	"github.com/toba/pbdb/key"
-	"toba.io/lib/oops"
+	"github.com/toba/pbdb/order"
 )
 
 // allInBucket transforms all bucket items to a list of byte slices using a
 // mapping function.
-func allInBucket(bucket *bolt.Bucket, m mapper) ([][]byte, error) {
+func allInBucket(bucket engine.Bucket, m mapper) ([][]byte, error) {
 	var list [][]byte
 
 	if bucket == nil {
@@ -23,64 +23,66 @@ func allInBucket(bucket *bolt.Bucket, m mapper) ([][]byte, error) {
 	return list, nil
 }
 
-// valueMap returns a Bolt item value. For indexes, this is the item key.
+// valueMap returns a bucket item value. For indexes, this is the item key.
 func valueMap(k, v []byte) []byte {
 	return v
 }
 
-// keyMap returns a Bolt item key. For indexes, this is the value that was
+// keyMap returns a bucket item key. For indexes, this is the value that was
 // indexed.
 func keyMap(k, v []byte) []byte {
 	return k
 }
 
-// allValues returns all values (item keys in the case of an index) from a
-// bucket.
-func allValues(bucket *bolt.Bucket) ([][]byte, error) {
-	return allInBucket(bucket, valueMap)
-}
-
 // allKeys returns all keys from a bucket.
-func allKeys(bucket *bolt.Bucket) ([][]byte, error) {
+func allKeys(bucket engine.Bucket) ([][]byte, error) {
 	return allInBucket(bucket, keyMap)
 }
 
 // validKeys evaluates both the value and item keys for proper length.
 func validKeys(valueKey, itemKey []byte) error {
 	if key.IsEmpty(valueKey) {
-		return oops.InvalidIndexKey
+		return ErrInvalidIndexKey
 	}
 	if !key.IsValid(itemKey) {
-		return oops.InvalidItemKey
+		return ErrInvalidItemKey
 	}
 	return nil
 }
 
-// firstPrefix is used to seek the first key matching a prefix.
-func firstPrefix(valueKey []byte) []byte {
-	return append(makePrefix(valueKey), key.Zero...)
+// makePrefix adds the separator to a value to begin the composite keys of a
+// legacy non-unique index. The value key is copied so its backing array is
+// never written.
+func makePrefix(valueKey []byte) []byte {
+	return append(valueKey[:len(valueKey):len(valueKey)], keySeparator)
 }
 
-// lastPrefix is used to limit a prefix range query.
-func lastPrefix(valueKey []byte) []byte {
-	return append(makePrefix(valueKey), key.Max...)
+// escapeValue encodes a value for a composite key with order.Bytes so no
+// encoded value is a prefix of another and encoded values sort in the same
+// order as the values themselves.
+func escapeValue(valueKey []byte) []byte {
+	return order.Bytes(valueKey)
 }
 
-// makePrefix adds the bytes to a key used to designate it as a prefix.
-func makePrefix(valueKey []byte) []byte {
-	return append(valueKey, keySeparator)
+// unescapeValue decodes a value encoded by escapeValue. ErrInvalidIndexKey
+// is returned if the encoding is malformed.
+func unescapeValue(encoded []byte) ([]byte, error) {
+	v, rest, err := order.DecodeBytes(encoded)
+	if err != nil || len(rest) > 0 {
+		return nil, ErrInvalidIndexKey
+	}
+	return v, nil
 }
 
-// makeCompositKey builds a key combined with its value, used for
-// non-unique indexes.
-func makeCompositeKey(valueKey, itemKey []byte) []byte {
-	return append(makePrefix(valueKey), itemKey...)
+// join returns a new slice with the bytes of b following those of a.
+func join(a, b []byte) []byte {
+	k := make([]byte, 0, len(a)+len(b))
+	return append(append(k, a...), b...)
 }
 
-// unique updates a list so it contains only unique keys.
-func unique(keys [][]byte) [][]byte {
-	if keys == nil {
-		return keys
-	}
-	return key.MergeLists(make([][]byte, 0), keys)
+// reverseKey builds the key of a reverse bucket entry. Item keys are a fixed
+// length so the item key alone is a prefix for all of the item's values.
+func reverseKey(valueKey, itemKey []byte) []byte {
+	k := make([]byte, 0, len(itemKey)+len(valueKey))
+	return append(append(k, itemKey...), valueKey...)
 }
@@ -104,3 +104,31 @@ func MergeLists(lists ...[][]byte) [][]byte {
 	}
 	return merged
 }
+
+// IntersectLists returns the keys contained in both lists, in the order they
+// appear in the first list.
+//
+// Keys are converted to strings for map lookups since index scans can match
+// many items and neither list is necessarily sorted.
+func IntersectLists(a, b [][]byte) [][]byte {
+	if len(a) == 0 || len(b) == 0 {
+		return nil
+	}
+	inB := make(map[string]struct{}, len(b))
+	for _, k := range b {
+		inB[string(k)] = struct{}{}
+	}
+	var both [][]byte
+
+	for _, k := range a {
+		if _, ok := inB[string(k)]; ok {
+			both = append(both, k)
+			// only include the first of any duplicates
+			delete(inB, string(k))
+		}
+	}
+	if len(both) == 0 {
+		return nil
+	}
+	return both
+}
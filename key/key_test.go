@@ -132,3 +132,28 @@ func TestMergeLists(t *testing.T) {
 	merged = key.MergeLists(emptyList1, list2, nil)
 	assert.Len(t, merged, 2)
 }
+
+func TestIntersectLists(t *testing.T) {
+	key1, err := key.Create()
+	time.Sleep(time.Millisecond)
+	key2, err := key.Create()
+	time.Sleep(time.Millisecond)
+	key3, err := key.Create()
+
+	assert.NoError(t, err)
+
+	list1 := [][]byte{key1, key2}
+	list2 := [][]byte{key2, key3}
+
+	both := key.IntersectLists(list1, list2)
+	assert.Len(t, both, 1)
+	assert.Equal(t, key2, both[0])
+
+	// keeps the order of the first list without duplicates
+	both = key.IntersectLists([][]byte{key3, key1, key2, key3}, [][]byte{key2, key3, key1})
+	assert.Equal(t, [][]byte{key3, key1, key2}, both)
+
+	// should return nil instead of empty list
+	assert.Nil(t, key.IntersectLists(list1, [][]byte{key3}))
+	assert.Nil(t, key.IntersectLists(nil, list2))
+}
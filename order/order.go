@@ -0,0 +1,262 @@
+// Package order encodes scalar values as bytes that sort in the same order as
+// the values themselves. Index keys are compared byte by byte so values must
+// be encoded this way for range queries to match their natural order.
+//
+// Every encoding is either a fixed length or ends with a terminator so
+// encoded values may be concatenated and decoded again in sequence.
+package order
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	// escapeByte begins a two byte sequence within an encoded string.
+	escapeByte byte = 0x00
+	// escapedByte follows escapeByte to encode a zero byte in a string.
+	escapedByte byte = 0xFF
+	// terminatorByte follows escapeByte to end an encoded string.
+	terminatorByte byte = 0x01
+
+	// signBit is flipped so negative numbers sort before positive ones.
+	signBit = 1 << 63
+)
+
+var (
+	// ErrUnsupportedType is returned when encoding a value with no order
+	// preserving encoding.
+	ErrUnsupportedType = errors.New("value type has no ordered encoding")
+	// ErrMalformed is returned when decoding bytes that weren't produced by
+	// the matching encoder.
+	ErrMalformed = errors.New("malformed ordered encoding")
+)
+
+// Int encodes a signed integer as eight bytes with the sign bit flipped so
+// negative numbers sort before positive ones.
+func Int(v int64) []byte {
+	return Uint(uint64(v) ^ signBit)
+}
+
+// Uint encodes an unsigned integer as eight big endian bytes.
+func Uint(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// Float encodes a float as eight bytes. Positive numbers have the sign bit
+// set and negative numbers have every bit inverted so larger magnitudes sort
+// first. Negative zero is encoded as zero. Every NaN is encoded the same and
+// sorts after positive infinity.
+func Float(v float64) []byte {
+	switch {
+	case math.IsNaN(v):
+		v = math.NaN()
+	case v == 0:
+		// -0 == 0 so both have the same encoding
+		v = 0
+	}
+	bits := math.Float64bits(v)
+	if bits&signBit != 0 {
+		bits = ^bits
+	} else {
+		bits |= signBit
+	}
+	return Uint(bits)
+}
+
+// Bool encodes false as zero and true as one.
+func Bool(v bool) []byte {
+	if v {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// Time encodes a time as the signed number of nanoseconds since the Unix
+// epoch. The time zone isn't kept and times are only ordered correctly
+// between the years 1678 and 2262.
+func Time(t time.Time) []byte {
+	return Int(t.UnixNano())
+}
+
+// String encodes a string so no encoded string is a prefix of another. Zero
+// bytes are followed by 0xFF and the string ends with a zero byte followed by
+// 0x01.
+//
+// Example:
+//
+//	ab       -> ab<00 01>
+//	ab<00>   -> ab<00 FF><00 01>
+//	abc      -> abc<00 01>
+func String(s string) []byte {
+	return Bytes([]byte(s))
+}
+
+// Fold encodes a string with String after converting it to lower case so
+// strings differing only in case are equal.
+func Fold(s string) []byte {
+	return String(strings.ToLower(s))
+}
+
+// Bytes encodes a byte slice the same as String.
+func Bytes(v []byte) []byte {
+	out := make([]byte, 0, len(v)+2)
+	for _, b := range v {
+		out = append(out, b)
+		if b == escapeByte {
+			out = append(out, escapedByte)
+		}
+	}
+	return append(out, escapeByte, terminatorByte)
+}
+
+// Value encodes a value of any supported type. Signed integers, unsigned
+// integers and floats of every size are encoded as Int, Uint and Float.
+// ErrUnsupportedType is returned for other types.
+func Value(v interface{}) ([]byte, error) {
+	switch t := v.(type) {
+	case int:
+		return Int(int64(t)), nil
+	case int8:
+		return Int(int64(t)), nil
+	case int16:
+		return Int(int64(t)), nil
+	case int32:
+		return Int(int64(t)), nil
+	case int64:
+		return Int(t), nil
+	case uint:
+		return Uint(uint64(t)), nil
+	case uint8:
+		return Uint(uint64(t)), nil
+	case uint16:
+		return Uint(uint64(t)), nil
+	case uint32:
+		return Uint(uint64(t)), nil
+	case uint64:
+		return Uint(t), nil
+	case float32:
+		return Float(float64(t)), nil
+	case float64:
+		return Float(t), nil
+	case bool:
+		return Bool(t), nil
+	case time.Time:
+		return Time(t), nil
+	case string:
+		return String(t), nil
+	case []byte:
+		return Bytes(t), nil
+	}
+	return nil, ErrUnsupportedType
+}
+
+// Tuple encodes several values with Value, one after another, as a single
+// key. Tuples sort by their first value then by each following value in
+// turn, and a tuple's encoding begins with the encoding of any tuple of its
+// leading values.
+func Tuple(values ...interface{}) ([]byte, error) {
+	var out []byte
+	for _, v := range values {
+		b, err := Value(v)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, b...)
+	}
+	return out, nil
+}
+
+// DecodeInt decodes an integer encoded by Int, returning the bytes that
+// follow it.
+func DecodeInt(b []byte) (int64, []byte, error) {
+	v, rest, err := DecodeUint(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	return int64(v ^ signBit), rest, nil
+}
+
+// DecodeUint decodes an integer encoded by Uint, returning the bytes that
+// follow it.
+func DecodeUint(b []byte) (uint64, []byte, error) {
+	if len(b) < 8 {
+		return 0, nil, ErrMalformed
+	}
+	return binary.BigEndian.Uint64(b), b[8:], nil
+}
+
+// DecodeFloat decodes a float encoded by Float, returning the bytes that
+// follow it.
+func DecodeFloat(b []byte) (float64, []byte, error) {
+	bits, rest, err := DecodeUint(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	if bits&signBit != 0 {
+		bits &^= signBit
+	} else {
+		bits = ^bits
+	}
+	return math.Float64frombits(bits), rest, nil
+}
+
+// DecodeBool decodes a bool encoded by Bool, returning the bytes that follow
+// it.
+func DecodeBool(b []byte) (bool, []byte, error) {
+	if len(b) < 1 || b[0] > 1 {
+		return false, nil, ErrMalformed
+	}
+	return b[0] == 1, b[1:], nil
+}
+
+// DecodeTime decodes a time encoded by Time, returning the bytes that follow
+// it. The time is in UTC.
+func DecodeTime(b []byte) (time.Time, []byte, error) {
+	v, rest, err := DecodeInt(b)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	return time.Unix(0, v).UTC(), rest, nil
+}
+
+// DecodeString decodes a string encoded by String or Fold, returning the
+// bytes that follow it.
+func DecodeString(b []byte) (string, []byte, error) {
+	v, rest, err := DecodeBytes(b)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(v), rest, nil
+}
+
+// DecodeBytes decodes a byte slice encoded by Bytes, returning the bytes
+// that follow it.
+func DecodeBytes(b []byte) ([]byte, []byte, error) {
+	out := make([]byte, 0, len(b))
+
+	for i := 0; i < len(b); i++ {
+		if b[i] != escapeByte {
+			out = append(out, b[i])
+			continue
+		}
+		if i+1 >= len(b) {
+			return nil, nil, ErrMalformed
+		}
+		i++
+		switch b[i] {
+		case escapedByte:
+			out = append(out, escapeByte)
+		case terminatorByte:
+			return out, b[i+1:], nil
+		default:
+			return nil, nil, ErrMalformed
+		}
+	}
+	return nil, nil, ErrMalformed
+}
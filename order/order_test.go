@@ -0,0 +1,208 @@
+package order_test
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/toba/pbdb/order"
+)
+
+// assertSorted checks that each encoding sorts before the next.
+func assertSorted(t *testing.T, encoded [][]byte) {
+	for i := 1; i < len(encoded); i++ {
+		assert.True(t, bytes.Compare(encoded[i-1], encoded[i]) < 0, "%x should sort before %x", encoded[i-1], encoded[i])
+	}
+}
+
+func TestInt(t *testing.T) {
+	values := []int64{math.MinInt64, -123456, -1, 0, 1, 56, 123456789, math.MaxInt64}
+	var encoded [][]byte
+
+	for _, v := range values {
+		b := order.Int(v)
+		assert.Len(t, b, 8)
+		encoded = append(encoded, b)
+
+		out, rest, err := order.DecodeInt(b)
+		assert.NoError(t, err)
+		assert.Empty(t, rest)
+		assert.Equal(t, v, out)
+	}
+	assertSorted(t, encoded)
+}
+
+func TestUint(t *testing.T) {
+	values := []uint64{0, 1984, 2017, math.MaxUint64}
+	var encoded [][]byte
+
+	for _, v := range values {
+		b := order.Uint(v)
+		encoded = append(encoded, b)
+
+		out, _, err := order.DecodeUint(b)
+		assert.NoError(t, err)
+		assert.Equal(t, v, out)
+	}
+	assertSorted(t, encoded)
+
+	_, _, err := order.DecodeUint([]byte{1, 2})
+	assert.Equal(t, order.ErrMalformed, err)
+}
+
+func TestFloat(t *testing.T) {
+	values := []float64{math.Inf(-1), -1e300, -2.5, -1, -math.SmallestNonzeroFloat64, 0, math.SmallestNonzeroFloat64, 0.5, 1, 1e300, math.Inf(1)}
+	var encoded [][]byte
+
+	for _, v := range values {
+		b := order.Float(v)
+		encoded = append(encoded, b)
+
+		out, _, err := order.DecodeFloat(b)
+		assert.NoError(t, err)
+		assert.Equal(t, v, out)
+	}
+	assertSorted(t, encoded)
+
+	negZero := math.Copysign(0, -1)
+	assert.Equal(t, order.Float(0), order.Float(negZero))
+	b, err := order.Value(float32(negZero))
+	assert.NoError(t, err)
+	assert.Equal(t, order.Float(0), b)
+
+	nan := order.Float(math.NaN())
+	assert.True(t, bytes.Compare(order.Float(math.Inf(1)), nan) < 0)
+	out, _, err := order.DecodeFloat(nan)
+	assert.NoError(t, err)
+	assert.True(t, math.IsNaN(out))
+}
+
+func TestBool(t *testing.T) {
+	assertSorted(t, [][]byte{order.Bool(false), order.Bool(true)})
+
+	v, _, err := order.DecodeBool(order.Bool(true))
+	assert.NoError(t, err)
+	assert.True(t, v)
+
+	_, _, err = order.DecodeBool([]byte{2})
+	assert.Equal(t, order.ErrMalformed, err)
+}
+
+func TestTime(t *testing.T) {
+	hired := time.Date(2017, time.March, 4, 9, 30, 0, 15, time.UTC)
+	values := []time.Time{
+		time.Date(1901, time.January, 1, 0, 0, 0, 0, time.UTC),
+		time.Unix(0, 0),
+		hired,
+		hired.Add(time.Nanosecond),
+	}
+	var encoded [][]byte
+
+	for _, v := range values {
+		encoded = append(encoded, order.Time(v))
+	}
+	assertSorted(t, encoded)
+
+	// the zone isn't kept
+	local := hired.In(time.FixedZone("MST", -7*60*60))
+	assert.Equal(t, order.Time(hired), order.Time(local))
+
+	out, _, err := order.DecodeTime(order.Time(local))
+	assert.NoError(t, err)
+	assert.True(t, hired.Equal(out))
+}
+
+func TestString(t *testing.T) {
+	values := []string{"", "a", "a\x00", "a\x00b", "a\x01", "ab", "b", "\xff"}
+	var encoded [][]byte
+
+	for _, v := range values {
+		b := order.String(v)
+		encoded = append(encoded, b)
+
+		out, rest, err := order.DecodeString(b)
+		assert.NoError(t, err)
+		assert.Empty(t, rest)
+		assert.Equal(t, v, out)
+	}
+	assertSorted(t, encoded)
+
+	assert.Equal(t, order.String("smith"), order.Fold("Smith"))
+
+	_, _, err := order.DecodeString([]byte("abc"))
+	assert.Equal(t, order.ErrMalformed, err)
+	_, _, err = order.DecodeString([]byte{'a', 0, 2})
+	assert.Equal(t, order.ErrMalformed, err)
+}
+
+func TestDecodeSequence(t *testing.T) {
+	b := append(order.String("Smith"), order.Int(-40)...)
+	b = append(b, order.Bool(true)...)
+
+	s, rest, err := order.DecodeString(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "Smith", s)
+
+	i, rest, err := order.DecodeInt(rest)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-40), i)
+
+	ok, rest, err := order.DecodeBool(rest)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Empty(t, rest)
+}
+
+func TestValue(t *testing.T) {
+	b, err := order.Value(int32(-5))
+	assert.NoError(t, err)
+	assert.Equal(t, order.Int(-5), b)
+
+	b, err = order.Value(uint8(5))
+	assert.NoError(t, err)
+	assert.Equal(t, order.Uint(5), b)
+
+	b, err = order.Value(float32(1.5))
+	assert.NoError(t, err)
+	assert.Equal(t, order.Float(1.5), b)
+
+	b, err = order.Value("text")
+	assert.NoError(t, err)
+	assert.Equal(t, order.String("text"), b)
+
+	b, err = order.Value(struct{}{})
+	assert.Equal(t, order.ErrUnsupportedType, err)
+	assert.Nil(t, b)
+}
+
+func TestTuple(t *testing.T) {
+	doe, err := order.Tuple("Doe")
+	assert.NoError(t, err)
+	janeDoe, err := order.Tuple("Doe", "Jane")
+	assert.NoError(t, err)
+	assert.Equal(t, append(order.String("Doe"), order.String("Jane")...), janeDoe)
+	assert.True(t, bytes.HasPrefix(janeDoe, doe))
+
+	// tuples sort by each value in turn
+	assertSorted(t, [][]byte{
+		must(order.Tuple("Doe", "Jane")),
+		must(order.Tuple("Doe", "John")),
+		must(order.Tuple("Doe\x00", "Adam")),
+		must(order.Tuple("Doer", "Adam")),
+		must(order.Tuple("Roe", -5)),
+		must(order.Tuple("Roe", 3)),
+	})
+
+	_, err = order.Tuple("Doe", struct{}{})
+	assert.Equal(t, order.ErrUnsupportedType, err)
+}
+
+// must returns an encoding, panicking if there was an error.
+func must(b []byte, err error) []byte {
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
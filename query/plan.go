@@ -1,13 +1,18 @@
 // Package query defines methods for retrieving values from a data file.
 package query
 
-// Plan defines the most efficient lookups for retrieving an item from BoltDB.
+import "github.com/toba/pbdb/index"
+
+// Plan defines the most efficient lookups for retrieving an item from a data
+// file.
 type (
 	Comparison int
 
 	UseIndex struct {
 		IndexBucket []byte
 		IndexKey    []byte
+		// Unique indicates the index bucket holds a unique index.
+		Unique bool
 	}
 
 	Plan struct {
@@ -23,9 +28,27 @@ func Bucket(name []byte) *Plan {
 	}
 }
 
-func (b *Plan) UseIndex(name, key []byte) {
+// Example builds a plan from the index map of an example value. Unique
+// indexes are listed first since they match at most one item. Definitions
+// with an empty value are skipped because the example doesn't constrain
+// that field.
+func Example(bucketName []byte, m index.Map) *Plan {
+	p := Bucket(bucketName)
+
+	for _, unique := range []bool{true, false} {
+		for _, d := range m.Definitions {
+			if d.Unique == unique && len(d.Value) > 0 {
+				p.UseIndex(d.BucketName, d.Value, d.Unique)
+			}
+		}
+	}
+	return p
+}
+
+func (b *Plan) UseIndex(name, key []byte, unique bool) {
 	b.Indexes = append(b.Indexes, UseIndex{
 		IndexBucket: name,
 		IndexKey:    key,
+		Unique:      unique,
 	})
 }
@@ -0,0 +1,312 @@
+package pbdb
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/toba/pbdb/engine"
+	"github.com/toba/pbdb/key"
+	"github.com/toba/pbdb/store"
+)
+
+type (
+	// TenantFile describes a tenant data file.
+	TenantFile struct {
+		ID []byte
+		// Size is the number of bytes the data file uses on disk.
+		Size int64
+		// Modified is when the data file was last written.
+		Modified time.Time
+		// Buckets is the number of keys in each bucket, including index
+		// buckets and the bucket recording usage, by bucket name.
+		Buckets map[string]int
+	}
+
+	// TenantItem is a value read from a tenant data file.
+	TenantItem struct {
+		TenantID []byte
+		Value    store.Value
+	}
+
+	// TenantFunc is executed within a read-only transaction on a tenant data
+	// file.
+	TenantFunc func(tenantID []byte, tx *Tx) error
+)
+
+// tenantPath returns the path of a tenant data file. Each tenant has its own
+// file in the root path named for the string form of its ULID.
+func (db *DB) tenantPath(tenantID []byte) (string, error) {
+	if !db.ready {
+		return "", ErrNotInitialized
+	}
+	if !key.IsValid(tenantID) {
+		return "", ErrInvalidTenant
+	}
+	name := key.ToString(tenantID)
+	if !validFileName.MatchString(name) {
+		return "", ErrInvalidDataFileName
+	}
+	return db.root + name, nil
+}
+
+// existingTenantPath returns the path of a tenant data file or
+// ErrTenantNotFound if it hasn't been created.
+func (db *DB) existingTenantPath(tenantID []byte) (string, error) {
+	p, err := db.tenantPath(tenantID)
+	if err != nil {
+		return "", err
+	}
+	_, err = os.Stat(p)
+	if os.IsNotExist(err) {
+		return "", ErrTenantNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+// leaseTenant returns a lease on an existing tenant data file and its path,
+// or ErrTenantNotFound if the tenant hasn't been created or was removed.
+func (db *DB) leaseTenant(tenantID []byte) (*Lease, string, error) {
+	db.tenants.RLock()
+	defer db.tenants.RUnlock()
+
+	p, err := db.existingTenantPath(tenantID)
+	if err != nil {
+		return nil, "", err
+	}
+	l, err := db.openPath(p)
+	if err != nil {
+		return nil, "", err
+	}
+	return l, p, nil
+}
+
+// CreateTenant creates a data file for a new tenant and returns the tenant
+// ID.
+func (db *DB) CreateTenant() ([]byte, error) {
+	tenantID, err := key.Create()
+	if err != nil {
+		return nil, err
+	}
+	p, err := db.tenantPath(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	l, err := db.files.Connect(p)
+	if err != nil {
+		return nil, err
+	}
+	return tenantID, l.Close()
+}
+
+// ListTenants returns the IDs of every tenant with a data file in the root
+// path. IDs are sorted so tenants created in different milliseconds are
+// listed in the order they were created.
+func (db *DB) ListTenants() ([][]byte, error) {
+	if !db.ready {
+		return nil, ErrNotInitialized
+	}
+	dir := db.root
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var tenants [][]byte
+
+	for _, e := range entries {
+		if id := tenantID(e.Name()); id != nil {
+			tenants = append(tenants, id)
+		}
+	}
+	return tenants, nil
+}
+
+// tenantID returns the tenant ID for a data file name or nil if the name is
+// not a tenant ID.
+func tenantID(name string) []byte {
+	if !validFileName.MatchString(name) {
+		return nil
+	}
+	id := key.FromString(name)
+	if !key.IsValid(id) || key.ToString(id) != name {
+		return nil
+	}
+	return id
+}
+
+// DeleteTenant closes and removes a tenant data file along with its quota and
+// usage. It returns ErrFileInUse if the file is being used.
+func (db *DB) DeleteTenant(tenantID []byte) error {
+	db.tenants.Lock()
+	defer db.tenants.Unlock()
+
+	p, err := db.existingTenantPath(tenantID)
+	if err != nil {
+		return err
+	}
+	if err := db.files.Remove(p); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(p); err != nil {
+		return err
+	}
+	return db.moveSystemRecords(tenantID, nil)
+}
+
+// RenameTenant moves a tenant data file, with its quota and usage, to a new
+// tenant ID. It returns ErrTenantExists if the new tenant already has a data
+// file and ErrFileInUse if the file is being used.
+func (db *DB) RenameTenant(tenantID, newID []byte) error {
+	db.tenants.Lock()
+	defer db.tenants.Unlock()
+
+	from, err := db.existingTenantPath(tenantID)
+	if err != nil {
+		return err
+	}
+	to, err := db.tenantPath(newID)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(to); err == nil {
+		return ErrTenantExists
+	}
+	if err := db.files.Remove(from); err != nil {
+		return err
+	}
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	return db.moveSystemRecords(tenantID, newID)
+}
+
+// TenantInfo returns the size, modification time and bucket counts of a
+// tenant data file.
+func (db *DB) TenantInfo(tenantID []byte) (*TenantFile, error) {
+	file, p, err := db.leaseTenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	info := &TenantFile{ID: tenantID, Buckets: make(map[string]int)}
+
+	info.Size, info.Modified, err = dataFileSize(p)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	err = withLease(file, false, func(tx engine.Tx) error {
+		return tx.ForEachBucket(func(name []byte) error {
+			count := 0
+			err := tx.Bucket(name).ForEach(func(k, v []byte) error {
+				count++
+				return nil
+			})
+			info.Buckets[string(name)] = count
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// ForEachTenant executes a function within a read-only transaction on every
+// tenant data file. At most concurrency functions run at once, or one at a
+// time if concurrency is less than one. After the first error no more
+// tenants are started and that error is returned. Tenants removed while
+// the function runs are skipped.
+func (db *DB) ForEachTenant(concurrency int, fn TenantFunc) error {
+	tenants, err := db.ListTenants()
+	if err != nil {
+		return err
+	}
+	return db.forTenants(tenants, concurrency, func(i int, tx *Tx) error {
+		return fn(tenants[i], tx)
+	})
+}
+
+// QueryAllTenants returns every item matching an example value in every
+// tenant data file, querying at most concurrency tenants at once. Items are
+// grouped by tenant in the order of ListTenants.
+func (db *DB) QueryAllTenants(example store.Value, concurrency int) ([]TenantItem, error) {
+	tenants, err := db.ListTenants()
+	if err != nil {
+		return nil, err
+	}
+	// each tenant only writes its own element
+	found := make([][]store.Value, len(tenants))
+
+	err = db.forTenants(tenants, concurrency, func(i int, tx *Tx) error {
+		var err error
+		found[i], err = tx.Query(example)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var items []TenantItem
+
+	for i, values := range found {
+		for _, v := range values {
+			items = append(items, TenantItem{TenantID: tenants[i], Value: v})
+		}
+	}
+	return items, nil
+}
+
+// forTenants executes a function, with the position of the tenant in the
+// list, within a read-only transaction on each tenant data file. Tenants
+// removed since they were listed are skipped.
+func (db *DB) forTenants(tenants [][]byte, concurrency int, fn func(i int, tx *Tx) error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var (
+		wg    sync.WaitGroup
+		once  sync.Once
+		first error
+		stop  = make(chan struct{})
+		slots = make(chan struct{}, concurrency)
+	)
+
+start:
+	for i := range tenants {
+		select {
+		case <-stop:
+			break start
+		case slots <- struct{}{}:
+		}
+		wg.Add(1)
+
+		go func(i int) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			err := db.TenantReader(tenants[i], func(tx *Tx) error {
+				return fn(i, tx)
+			})
+			if err != nil && err != ErrTenantNotFound {
+				once.Do(func() {
+					first = err
+					close(stop)
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+	return first
+}
@@ -0,0 +1,250 @@
+package pbdb_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	db "github.com/toba/pbdb"
+	"github.com/toba/pbdb/engine"
+	"github.com/toba/pbdb/key"
+)
+
+// withDatabase opens a database in a temporary directory for each storage
+// engine.
+func withDatabase(t *testing.T, fn func(t *testing.T, d *db.DB)) {
+	for _, k := range []engine.Kind{engine.Bolt, engine.Badger} {
+		t.Run(k.String(), func(t *testing.T) {
+			dir, err := ioutil.TempDir(os.TempDir(), "toba")
+			assert.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			d, err := db.Open(db.Options{Path: dir, Name: "test.db", Storage: k})
+			assert.NoError(t, err)
+			defer d.Close()
+
+			fn(t, d)
+		})
+	}
+}
+
+// withBadger opens a database in a temporary directory using Badger, whose
+// transactions are executed again when they conflict.
+func withBadger(t *testing.T, fn func(d *db.DB)) {
+	dir, err := ioutil.TempDir(os.TempDir(), "toba")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	d, err := db.Open(db.Options{Path: dir, Name: "test.db", Storage: engine.Badger})
+	assert.NoError(t, err)
+	defer d.Close()
+
+	fn(d)
+}
+
+func TestTenantLifecycle(t *testing.T) {
+	withDatabase(t, func(t *testing.T, d *db.DB) {
+		first, err := d.CreateTenant()
+		assert.NoError(t, err)
+		second, err := d.CreateTenant()
+		assert.NoError(t, err)
+
+		tenants, err := d.ListTenants()
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, [][]byte{first, second}, tenants)
+
+		renamed, err := key.Create()
+		assert.NoError(t, err)
+		assert.Equal(t, db.ErrTenantExists, d.RenameTenant(first, second))
+		assert.NoError(t, d.RenameTenant(first, renamed))
+
+		tenants, err = d.ListTenants()
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, [][]byte{second, renamed}, tenants)
+
+		assert.NoError(t, d.DeleteTenant(second))
+		assert.Equal(t, db.ErrTenantNotFound, d.DeleteTenant(second))
+		assert.Equal(t, db.ErrTenantNotFound, d.RenameTenant(second, first))
+
+		tenants, err = d.ListTenants()
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{renamed}, tenants)
+
+		assert.Equal(t, db.ErrInvalidTenant, d.DeleteTenant([]byte("invalid")))
+	})
+}
+
+func TestTenantInUse(t *testing.T) {
+	withDatabase(t, func(t *testing.T, d *db.DB) {
+		tenantID, err := d.CreateTenant()
+		assert.NoError(t, err)
+
+		cn, err := d.OpenFile(key.ToString(tenantID))
+		assert.NoError(t, err)
+		assert.Equal(t, db.ErrFileInUse, d.DeleteTenant(tenantID))
+
+		assert.NoError(t, cn.Close())
+		assert.NoError(t, d.DeleteTenant(tenantID))
+	})
+}
+
+func TestUnknownTenant(t *testing.T) {
+	withDatabase(t, func(t *testing.T, d *db.DB) {
+		existing, err := d.CreateTenant()
+		assert.NoError(t, err)
+		deleted, err := d.CreateTenant()
+		assert.NoError(t, err)
+		assert.NoError(t, d.DeleteTenant(deleted))
+		unknown, err := key.Create()
+		assert.NoError(t, err)
+
+		before, err := d.ListTenants()
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{existing}, before)
+
+		for _, tenantID := range [][]byte{unknown, deleted} {
+			_, err = d.TenantHas(tenantID, &TestSchema{Name: "name"})
+			assert.Equal(t, db.ErrTenantNotFound, err)
+			_, err = d.TenantGet(tenantID, &TestSchema{Name: "name"})
+			assert.Equal(t, db.ErrTenantNotFound, err)
+			_, err = d.TenantQuery(tenantID, &TestLog{})
+			assert.Equal(t, db.ErrTenantNotFound, err)
+			_, err = d.TenantAdd(tenantID, &TestLog{Message: "log"})
+			assert.Equal(t, db.ErrTenantNotFound, err)
+			err = d.TenantReader(tenantID, func(tx *db.Tx) error { return nil })
+			assert.Equal(t, db.ErrTenantNotFound, err)
+			_, err = d.TenantInfo(tenantID)
+			assert.Equal(t, db.ErrTenantNotFound, err)
+		}
+
+		// no data file was created for either tenant
+		after, err := d.ListTenants()
+		assert.NoError(t, err)
+		assert.Equal(t, before, after)
+	})
+}
+
+func TestTenantInfo(t *testing.T) {
+	withDatabase(t, func(t *testing.T, d *db.DB) {
+		tenantID, err := d.CreateTenant()
+		assert.NoError(t, err)
+
+		cn, err := d.OpenFile(key.ToString(tenantID))
+		assert.NoError(t, err)
+		err = cn.Update(func(tx engine.Tx) error {
+			b, err := tx.CreateBucketIfNotExists(bucketName)
+			if err != nil {
+				return err
+			}
+			for _, k := range []string{"one", "two"} {
+				if err := b.Put([]byte(k), []byte(k)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, cn.Close())
+
+		info, err := d.TenantInfo(tenantID)
+		assert.NoError(t, err)
+		assert.Equal(t, tenantID, info.ID)
+		assert.True(t, info.Size > 0)
+		assert.False(t, info.Modified.IsZero())
+		assert.Equal(t, map[string]int{string(bucketName): 2}, info.Buckets)
+
+		missing, err := key.Create()
+		assert.NoError(t, err)
+		_, err = d.TenantInfo(missing)
+		assert.Equal(t, db.ErrTenantNotFound, err)
+	})
+}
+
+func TestQueryAllTenants(t *testing.T) {
+	withDatabase(t, func(t *testing.T, d *db.DB) {
+		var tenants [][]byte
+
+		for i := 0; i < 5; i++ {
+			tenantID, err := d.CreateTenant()
+			assert.NoError(t, err)
+			tenants = append(tenants, tenantID)
+
+			// every other tenant has a match
+			for j := 0; j < i%2+1; j++ {
+				_, err = d.TenantAdd(tenantID, &TestLog{Message: "fan out"})
+				assert.NoError(t, err)
+			}
+			_, err = d.TenantAdd(tenantID, &TestLog{Message: "other"})
+			assert.NoError(t, err)
+		}
+
+		items, err := d.QueryAllTenants(&TestLog{Message: "fan out"}, 2)
+		assert.NoError(t, err)
+		assert.Len(t, items, 7)
+
+		perTenant := make(map[string]int)
+		for _, item := range items {
+			assert.Equal(t, "fan out", item.Value.(*TestLog).Message)
+			perTenant[string(item.TenantID)]++
+		}
+		for i, id := range tenants {
+			assert.Equal(t, i%2+1, perTenant[string(id)])
+		}
+	})
+}
+
+func TestForEachTenantError(t *testing.T) {
+	withDatabase(t, func(t *testing.T, d *db.DB) {
+		for i := 0; i < 4; i++ {
+			_, err := d.CreateTenant()
+			assert.NoError(t, err)
+		}
+		fail := errors.New("fail")
+		var mu sync.Mutex
+		count := 0
+
+		err := d.ForEachTenant(1, func(tenantID []byte, tx *db.Tx) error {
+			assert.False(t, tx.Writable())
+			mu.Lock()
+			defer mu.Unlock()
+			count++
+			return fail
+		})
+		assert.Equal(t, fail, err)
+		// no more tenants are started after an error
+		assert.Equal(t, 1, count)
+	})
+}
+
+func TestForEachTenantDeleted(t *testing.T) {
+	withDatabase(t, func(t *testing.T, d *db.DB) {
+		for i := 0; i < 3; i++ {
+			_, err := d.CreateTenant()
+			assert.NoError(t, err)
+		}
+		// tenants created in the same millisecond aren't listed in order
+		tenants, err := d.ListTenants()
+		assert.NoError(t, err)
+		var visited [][]byte
+
+		err = d.ForEachTenant(1, func(tenantID []byte, tx *db.Tx) error {
+			visited = append(visited, tenantID)
+			if len(visited) == 1 {
+				// removed after being listed
+				return d.DeleteTenant(tenants[1])
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{tenants[0], tenants[2]}, visited)
+
+		// the deleted tenant isn't re-created
+		list, err := d.ListTenants()
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{tenants[0], tenants[2]}, list)
+	})
+}
@@ -0,0 +1,412 @@
+package pbdb
+
+import (
+	"bytes"
+
+	"github.com/toba/pbdb/engine"
+	"github.com/toba/pbdb/index"
+	"github.com/toba/pbdb/key"
+	"github.com/toba/pbdb/query"
+	"github.com/toba/pbdb/store"
+)
+
+type (
+	// Tx is a transaction on a single data file. Every item and index change
+	// made through a writable Tx is committed together or not at all.
+	Tx struct {
+		tx engine.Tx
+		// codecFor returns the codec for a value in the transaction's data
+		// file.
+		codecFor func(v interface{}) Codec
+		// usage accumulates changes to tenant storage in a writable tenant
+		// transaction. It is nil for other transactions.
+		usage *txUsage
+	}
+
+	// TxFunc is executed within a transaction.
+	TxFunc func(tx *Tx) error
+)
+
+// Update executes a function within a writable transaction on a data file.
+// The transaction is committed if the function returns no error and rolled
+// back otherwise.
+// On Badger the function is executed again if the transaction conflicts with
+// another, so it shouldn't change anything outside the transaction.
+func (db *DB) Update(f DataFile, fn TxFunc) error {
+	return db.transact(f, true, fn)
+}
+
+// View executes a function within a read-only transaction on a data file.
+func (db *DB) View(f DataFile, fn TxFunc) error {
+	return db.transact(f, false, fn)
+}
+
+// transact executes a function within a transaction on a data file using the
+// codecs configured for that file.
+func (db *DB) transact(f DataFile, writable bool, fn TxFunc) error {
+	if !db.ready {
+		return ErrNotInitialized
+	}
+	return db.withTransaction(db.path[f], writable, func(tx engine.Tx) error {
+		return fn(&Tx{
+			tx:       tx,
+			codecFor: func(v interface{}) Codec { return db.codecFor(f, v) },
+		})
+	})
+}
+
+// TenantWriter executes a function within a writable transaction on a
+// tenant data file. The transaction is committed if the function returns no
+// error and rolled back otherwise. As for Update, the function may be
+// executed more than once on Badger.
+func (db *DB) TenantWriter(tenantID []byte, fn TxFunc) error {
+	return db.tenantTransaction(tenantID, true, fn)
+}
+
+// TenantReader executes a function within a read-only transaction on a
+// tenant data file.
+func (db *DB) TenantReader(tenantID []byte, fn TxFunc) error {
+	return db.tenantTransaction(tenantID, false, fn)
+}
+
+// tenantTransaction executes a function within a transaction on a tenant
+// data file, returning ErrTenantNotFound if the tenant hasn't been created.
+// Tenant values use their default codec. A writable transaction reads the
+// tenant's recorded usage, checks additions against its quota and records
+// the changed usage before it commits, then copies the usage to the system
+// data file.
+func (db *DB) tenantTransaction(tenantID []byte, writable bool, fn TxFunc) error {
+	file, p, err := db.leaseTenant(tenantID)
+	if err != nil {
+		return err
+	}
+	if !writable {
+		return withLease(file, false, func(tx engine.Tx) error {
+			return fn(&Tx{tx: tx, codecFor: CodecFor})
+		})
+	}
+	q, size, err := db.tenantLimits(tenantID, p)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	changed := false
+
+	err = withLease(file, true, func(tx engine.Tx) error {
+		// usage is read again if the transaction is retried
+		usage, err := beginUsage(tx, tenantID, q, size)
+		if err != nil {
+			return err
+		}
+		if err := fn(&Tx{tx: tx, codecFor: CodecFor, usage: usage}); err != nil {
+			return err
+		}
+		changed = usage.changed()
+		return usage.record(tx)
+	})
+	if err != nil || !changed {
+		return err
+	}
+	// the write has committed so it isn't failed if the copy can't be made,
+	// which only leaves the copy stale until the tenant's next write
+	db.copyUsage(tenantID)
+	return nil
+}
+
+// Writable indicates whether items may be changed in the transaction.
+func (tx *Tx) Writable() bool {
+	return tx.tx.Writable()
+}
+
+// Has indicates whether the data file contains a value. Any existing unique
+// index with a value from the example decides the match. Otherwise every
+// item in the bucket is compared to the encoded example. A bucket that
+// doesn't exist has no values.
+func (tx *Tx) Has(v store.Value) (bool, error) {
+	c := tx.codecFor(v)
+	bucket := tx.tx.Bucket(v.BucketName())
+	if bucket == nil {
+		return false, nil
+	}
+	if err := checkCodec(tx.tx, v.BucketName(), c, false); err != nil {
+		return false, err
+	}
+	checked := false
+
+	for _, d := range v.IndexMap().Definitions {
+		if !d.Unique || len(d.Value) == 0 {
+			continue
+		}
+		idx := index.GetUnique(tx.tx, d.BucketName)
+		if idx == nil {
+			continue
+		}
+		if idx.FirstWithValue(d.Value) != nil {
+			return true, nil
+		}
+		checked = true
+	}
+	if checked {
+		return false, nil
+	}
+
+	data, err := c.Marshal(v)
+	if err != nil {
+		return false, err
+	}
+	exists := false
+
+	err = bucket.ForEach(func(k, item []byte) error {
+		if bytes.Equal(item, data) {
+			exists = true
+			return errStop
+		}
+		return nil
+	})
+	if err == errStop {
+		err = nil
+	}
+	return exists, err
+}
+
+// HasKey indicates if a bucket contains a key.
+func (tx *Tx) HasKey(bucketName, key []byte) (bool, error) {
+	bucket := tx.tx.Bucket(bucketName)
+	if bucket == nil {
+		return false, ErrNoBucket
+	}
+	return bucket.Get(key) != nil, nil
+}
+
+// Get a value based on an example value. The example's index map builds a
+// lookup plan that is resolved through the named index buckets and the first
+// matching item is decoded into a new value of the same type as the example.
+func (tx *Tx) Get(v store.Value) (store.Value, error) {
+	plan := query.Example(v.BucketName(), v.IndexMap())
+	if len(plan.Indexes) == 0 {
+		return nil, ErrNoIndex
+	}
+	c := tx.codecFor(v)
+	bucket := tx.tx.Bucket(plan.ItemBucket)
+	if bucket == nil {
+		return nil, ErrNoBucket
+	}
+	if err := checkCodec(tx.tx, plan.ItemBucket, c, false); err != nil {
+		return nil, err
+	}
+	keys, err := planItemKeys(tx.tx, plan)
+	if err != nil {
+		return nil, err
+	}
+	if keys == nil {
+		return nil, ErrNotFound
+	}
+	data := bucket.Get(keys[0])
+	if data == nil {
+		return nil, ErrNotFound
+	}
+	out := newValue(v)
+	if err := c.Unmarshal(data, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetKey returns the item at a key decoded into a new value of the same type
+// as the example.
+func (tx *Tx) GetKey(k []byte, example store.Value) (store.Value, error) {
+	c := tx.codecFor(example)
+	bucket := tx.tx.Bucket(example.BucketName())
+	if bucket == nil {
+		return nil, ErrNoBucket
+	}
+	if err := checkCodec(tx.tx, example.BucketName(), c, false); err != nil {
+		return nil, err
+	}
+	data := bucket.Get(k)
+	if data == nil {
+		return nil, ErrNotFound
+	}
+	out := newValue(example)
+	if err := c.Unmarshal(data, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Indexes returns the catalog entries for the indexes of a bucket, sorted by
+// index name. Every index is returned if the bucket name is nil.
+func (tx *Tx) Indexes(bucketName []byte) ([]*index.Info, error) {
+	return index.Catalog(tx.tx, bucketName)
+}
+
+// Query returns every item matching an example value. Matches are found
+// through the example's indexes or, if it has no indexed values, by
+// comparison with every item in the bucket. There is no error if the bucket
+// doesn't exist.
+func (tx *Tx) Query(example store.Value) ([]store.Value, error) {
+	c := tx.codecFor(example)
+	bucket := tx.tx.Bucket(example.BucketName())
+	if bucket == nil {
+		return nil, nil
+	}
+	if err := checkCodec(tx.tx, example.BucketName(), c, false); err != nil {
+		return nil, err
+	}
+	keys, err := matchingItemKeys(tx.tx, bucket, c, example)
+	if err != nil {
+		return nil, err
+	}
+	return decodeItems(bucket, c, example, keys)
+}
+
+// QueryRange returns the items in the bucket of an example value whose
+// values in the named index are between min and max, inclusive, in index
+// order. A nil min or max leaves that end of the range open. Values should be
+// encoded with the order package so byte order matches the order of the
+// values. There is no error if the bucket or index doesn't exist or the index
+// isn't in the catalog.
+func (tx *Tx) QueryRange(example store.Value, indexName, min, max []byte, opts *index.QueryOptions) ([]store.Value, error) {
+	return tx.queryIndex(example, indexName, func(idx index.Index) ([][]byte, error) {
+		return idx.AllInRange(min, max, opts)
+	})
+}
+
+// QueryPrefixRange returns the items in the bucket of an example value whose
+// values in the named index begin with a prefix followed by bytes between min
+// and max, inclusive, in index order. For a composite index the prefix holds
+// the encoded leading fields to match exactly and min and max bound the next
+// field. There is no error if the bucket or index doesn't exist or the index
+// isn't in the catalog.
+func (tx *Tx) QueryPrefixRange(example store.Value, indexName, prefix, min, max []byte, opts *index.QueryOptions) ([]store.Value, error) {
+	return tx.queryIndex(example, indexName, func(idx index.Index) ([][]byte, error) {
+		return idx.AllInPrefixRange(prefix, min, max, opts)
+	})
+}
+
+// queryIndex decodes the items in the bucket of an example value at the item
+// keys a function returns from the named catalog index.
+func (tx *Tx) queryIndex(example store.Value, indexName []byte, keysFrom func(index.Index) ([][]byte, error)) ([]store.Value, error) {
+	c := tx.codecFor(example)
+	bucket := tx.tx.Bucket(example.BucketName())
+	if bucket == nil {
+		return nil, nil
+	}
+	if err := checkCodec(tx.tx, example.BucketName(), c, false); err != nil {
+		return nil, err
+	}
+	info, err := index.Lookup(tx.tx, indexName)
+	if err != nil || info == nil {
+		return nil, err
+	}
+	idx := existingIndex(tx.tx, &index.Definition{BucketName: indexName, Unique: info.Unique})
+	if idx == nil {
+		return nil, nil
+	}
+	keys, err := keysFrom(idx)
+	if err != nil {
+		return nil, err
+	}
+	return decodeItems(bucket, c, example, keys)
+}
+
+// Add a value and its indexes, returning the generated item key. The indexes
+// are defined by the store.Value interface. In a tenant data file a
+// QuotaError is returned if the tenant has reached its quota.
+func (tx *Tx) Add(v store.Value) ([]byte, error) {
+	k, err := key.Create()
+	if err != nil {
+		return nil, err
+	}
+	return k, tx.save(k, v)
+}
+
+// Update an existing value. Index entries for values that changed since the
+// item was last saved are replaced. If no item has the key then the value is
+// added and, as for Add, a QuotaError is returned if a tenant has reached its
+// quota.
+func (tx *Tx) Update(k []byte, v store.Value) error {
+	return tx.save(k, v)
+}
+
+// save a value and record the change in tenant usage, first checking the
+// tenant quota if the value is a new item.
+func (tx *Tx) save(k []byte, v store.Value) error {
+	if tx.usage != nil && !tx.exists(k, v) {
+		if err := tx.usage.check(); err != nil {
+			return err
+		}
+	}
+	created, written, err := save(tx.tx, tx.codecFor(v), k, v)
+	if err != nil {
+		return err
+	}
+	if tx.usage != nil {
+		var items int64
+		if created {
+			items = 1
+		}
+		tx.usage.add(v.BucketName(), items, written)
+	}
+	return nil
+}
+
+// exists indicates whether the bucket of a value has an item at a key.
+func (tx *Tx) exists(k []byte, v store.Value) bool {
+	bucket := tx.tx.Bucket(v.BucketName())
+	return bucket != nil && bucket.Get(k) != nil
+}
+
+// Delete removes the item at a key along with every index entry referencing
+// it. The value only identifies the bucket. There is no error if the item
+// doesn't exist.
+func (tx *Tx) Delete(k []byte, v store.Value) error {
+	c := tx.codecFor(v)
+	bucket := tx.tx.Bucket(v.BucketName())
+	if bucket == nil {
+		return nil
+	}
+	if err := checkCodec(tx.tx, v.BucketName(), c, false); err != nil {
+		return err
+	}
+	if bucket.Get(k) == nil {
+		return nil
+	}
+	if err := deleteItem(tx.tx, bucket, c, k, v); err != nil {
+		return err
+	}
+	if tx.usage != nil {
+		tx.usage.add(v.BucketName(), -1, 0)
+	}
+	return nil
+}
+
+// DeleteMatching removes all items matching an example value, and their
+// index entries, returning the number of items removed. Matches are found
+// as for Query.
+func (tx *Tx) DeleteMatching(example store.Value) (int, error) {
+	c := tx.codecFor(example)
+	bucket := tx.tx.Bucket(example.BucketName())
+	if bucket == nil {
+		return 0, nil
+	}
+	if err := checkCodec(tx.tx, example.BucketName(), c, false); err != nil {
+		return 0, err
+	}
+	keys, err := matchingItemKeys(tx.tx, bucket, c, example)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+
+	for _, k := range keys {
+		if err := deleteItem(tx.tx, bucket, c, k, example); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if tx.usage != nil {
+		tx.usage.add(example.BucketName(), -int64(count), 0)
+	}
+	return count, nil
+}
@@ -0,0 +1,138 @@
+package pbdb_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	db "github.com/toba/pbdb"
+	"github.com/toba/pbdb/index"
+)
+
+func TestTransaction(t *testing.T) {
+	var first, second []byte
+
+	err := db.Update(db.SystemFile, func(tx *db.Tx) error {
+		var err error
+		if first, err = tx.Add(&TestSchema{Name: "TxFirst"}); err != nil {
+			return err
+		}
+		second, err = tx.Add(&TestLog{Message: "TxSecond"})
+		return err
+	})
+	assert.NoError(t, err)
+
+	err = db.View(db.SystemFile, func(tx *db.Tx) error {
+		assert.False(t, tx.Writable())
+
+		v, err := tx.GetKey(first, &TestSchema{})
+		assert.NoError(t, err)
+		assert.Equal(t, "TxFirst", v.(*TestSchema).Name)
+
+		exists, err := tx.HasKey([]byte("TestLog"), second)
+		assert.NoError(t, err)
+		assert.True(t, exists)
+		return nil
+	})
+	assert.NoError(t, err)
+
+	// read-modify-write in one transaction
+	err = db.Update(db.SystemFile, func(tx *db.Tx) error {
+		v, err := tx.GetKey(first, &TestSchema{})
+		if err != nil {
+			return err
+		}
+		item := v.(*TestSchema)
+		item.Subdomain = "TxSubdomain"
+		return tx.Update(first, item)
+	})
+	assert.NoError(t, err)
+
+	v, err := db.Get(db.SystemFile, &TestSchema{Name: "TxFirst"})
+	assert.NoError(t, err)
+	assert.Equal(t, "TxSubdomain", v.(*TestSchema).Subdomain)
+}
+
+func TestTransactionRollback(t *testing.T) {
+	fail := errors.New("fail")
+
+	err := db.Update(db.SystemFile, func(tx *db.Tx) error {
+		if _, err := tx.Add(&TestSchema{Name: "TxRollback"}); err != nil {
+			return err
+		}
+		return fail
+	})
+	assert.Equal(t, fail, err)
+
+	// nothing from the failed transaction should be saved
+	exists, err := db.SystemHas(&TestSchema{Name: "TxRollback"})
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	// a unique index conflict rolls back every change
+	_, err = db.SystemAdd(&TestSchema{Name: "TxTaken"})
+	assert.NoError(t, err)
+
+	err = db.Update(db.SystemFile, func(tx *db.Tx) error {
+		if _, err := tx.Add(&TestLog{Message: "TxConflict"}); err != nil {
+			return err
+		}
+		_, err := tx.Add(&TestSchema{Name: "TxTaken"})
+		return err
+	})
+	assert.Equal(t, db.ErrAlreadyExists, err)
+
+	exists, err = db.SystemHas(&TestLog{Message: "TxConflict"})
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestTransactionQuery(t *testing.T) {
+	for i := 0; i < 3; i++ {
+		_, err := db.SystemAdd(&TestLog{Message: "TxQuery"})
+		assert.NoError(t, err)
+	}
+	err := db.View(db.SystemFile, func(tx *db.Tx) error {
+		matches, err := tx.Query(&TestLog{Message: "TxQuery"})
+		assert.NoError(t, err)
+		assert.Len(t, matches, 3)
+		assert.IsType(t, &TestLog{}, matches[0])
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+// TestAlias uses the TestSchema index name without a unique index.
+type TestAlias struct {
+	Name string
+}
+
+func (t *TestAlias) BucketName() []byte { return bucketName }
+func (t *TestAlias) IndexMap() index.Map {
+	return index.Define([]byte(t.Name), indexName, false)
+}
+
+func TestIndexCatalog(t *testing.T) {
+	withDatabase(t, func(t *testing.T, d *db.DB) {
+		list, err := d.Indexes(db.SystemFile, bucketName)
+		assert.NoError(t, err)
+		assert.Empty(t, list)
+
+		_, err = d.SystemAdd(&TestSchema{Name: "catalog"})
+		assert.NoError(t, err)
+
+		list, err = d.Indexes(db.SystemFile, bucketName)
+		assert.NoError(t, err)
+		assert.Len(t, list, 1)
+		assert.Equal(t, indexName, list[0].Name)
+		assert.True(t, list[0].Unique)
+
+		_, err = d.SystemAdd(&TestAlias{Name: "alias"})
+		assert.Equal(t, db.ErrIndexMismatch, err)
+
+		has, err := d.Has(db.SystemFile, &TestSchema{Name: "alias"})
+		assert.NoError(t, err)
+		assert.False(t, has)
+	})
+}
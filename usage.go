@@ -0,0 +1,398 @@
+package pbdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/toba/pbdb/engine"
+)
+
+type (
+	// Usage is the storage used by a tenant. Item counts and bytes written
+	// are recorded in the tenant data file by the same transaction that
+	// changes its items. Once that transaction commits the usage is copied
+	// to the system data file so ForEachTenantUsage can read every tenant's
+	// usage in one place.
+	Usage struct {
+		// Items is the number of items in each bucket by bucket name. Index
+		// buckets are not counted.
+		Items map[string]int64
+		// BytesWritten is the total size of every encoded item written,
+		// including items later replaced or deleted.
+		BytesWritten int64
+		// FileSize is the number of bytes the data file uses on disk. It is
+		// measured when usage is read rather than recorded.
+		FileSize int64
+	}
+
+	// Quota limits the storage a tenant may use. Zero fields are unlimited.
+	Quota struct {
+		// MaxItems limits the number of items in all buckets.
+		MaxItems int64
+		// MaxBytesWritten limits Usage.BytesWritten.
+		MaxBytesWritten int64
+		// MaxFileSize limits Usage.FileSize. Since the size is measured
+		// before a write, the last write may exceed it.
+		MaxFileSize int64
+	}
+
+	// QuotaError is returned when adding an item would exceed a tenant
+	// quota. It matches ErrQuotaExceeded with errors.Is.
+	QuotaError struct {
+		TenantID []byte
+		// Limit is the name of the Quota field that was exceeded.
+		Limit string
+		// Used is the usage measured against the limit.
+		Used int64
+		Max  int64
+	}
+
+	// txUsage accumulates changes to tenant usage within a writable
+	// transaction.
+	txUsage struct {
+		tenantID []byte
+		// used is the recorded usage read by the transaction.
+		used  Usage
+		quota Quota
+		// fileSize is the size of the data file when the transaction began.
+		fileSize int64
+		// items is the change in the number of items by bucket name.
+		items   map[string]int64
+		written int64
+	}
+)
+
+var (
+	// usageBucket in a tenant data file holds its encoded Usage at
+	// usageKey. Every write that changes usage also writes this key, so
+	// concurrent writers are serialized by the storage engine. In the system
+	// data file it maps tenant IDs to a copy of their encoded Usage.
+	usageBucket = []byte("_usage_")
+	usageKey    = []byte("usage")
+	// quotaBucket in the system data file maps tenant IDs to an encoded
+	// Quota chosen with SetTenantQuota.
+	quotaBucket = []byte("_quota_")
+)
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("tenant quota exceeded: %s is %d of %d", e.Limit, e.Used, e.Max)
+}
+
+// Is reports whether target is ErrQuotaExceeded.
+func (e *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// ItemCount returns the number of items in all buckets.
+func (u *Usage) ItemCount() int64 {
+	var count int64
+	for _, n := range u.Items {
+		count += n
+	}
+	return count
+}
+
+// TenantUsage returns the recorded storage used by a tenant. A tenant that
+// hasn't written anything has empty usage.
+func (db *DB) TenantUsage(tenantID []byte) (*Usage, error) {
+	file, p, err := db.leaseTenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	u := &Usage{}
+
+	err = withLease(file, false, func(tx engine.Tx) error {
+		return readUsage(tx, u)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if u.FileSize, _, err = dataFileSize(p); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// ForEachTenantUsage executes a function with the usage of every tenant
+// copied to the system data file, stopping at the first error. A copy is
+// made after each write so may lag TenantUsage while a write is committing,
+// and FileSize is measured when the copy is made. Tenants that haven't
+// written anything aren't included.
+func (db *DB) ForEachTenantUsage(fn func(tenantID []byte, u *Usage) error) error {
+	var (
+		tenants [][]byte
+		list    []*Usage
+	)
+	err := db.withTransaction(db.path[SystemFile], false, func(tx engine.Tx) error {
+		bucket := tx.Bucket(usageBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			u := &Usage{}
+			if err := Decode(v, u); err != nil {
+				return err
+			}
+			tenants = append(tenants, append([]byte(nil), k...))
+			list = append(list, u)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	// the function runs outside the transaction so it may write
+	for i, u := range list {
+		if err := fn(tenants[i], u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TenantQuota returns the quota chosen for a tenant with SetTenantQuota or,
+// if there is none, Options.Quota.
+func (db *DB) TenantQuota(tenantID []byte) (Quota, error) {
+	if _, err := db.tenantPath(tenantID); err != nil {
+		return Quota{}, err
+	}
+	q := db.quota
+
+	err := db.withTransaction(db.path[SystemFile], false, func(tx engine.Tx) error {
+		return readSystem(tx, quotaBucket, tenantID, &q)
+	})
+	return q, err
+}
+
+// SetTenantQuota records a quota for a tenant in place of Options.Quota. A
+// zero quota restores the default.
+func (db *DB) SetTenantQuota(tenantID []byte, q Quota) error {
+	if _, err := db.tenantPath(tenantID); err != nil {
+		return err
+	}
+	return db.withTransaction(db.path[SystemFile], true, func(tx engine.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(quotaBucket)
+		if err != nil {
+			return err
+		}
+		if q == (Quota{}) {
+			return bucket.Delete(tenantID)
+		}
+		data, err := Encode(q)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(tenantID, data)
+	})
+}
+
+// tenantLimits returns the quota of a tenant and the current size of its data
+// file, for checking writes against.
+func (db *DB) tenantLimits(tenantID []byte, p string) (Quota, int64, error) {
+	q, err := db.TenantQuota(tenantID)
+	if err != nil {
+		return Quota{}, 0, err
+	}
+	size, _, err := dataFileSize(p)
+	return q, size, err
+}
+
+// beginUsage reads the recorded usage of a tenant within a writable
+// transaction on its data file.
+func beginUsage(tx engine.Tx, tenantID []byte, q Quota, size int64) (*txUsage, error) {
+	u := &txUsage{
+		tenantID: tenantID,
+		quota:    q,
+		fileSize: size,
+		items:    make(map[string]int64),
+	}
+	if err := readUsage(tx, &u.used); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// readUsage decodes the usage recorded in a tenant data file. Items is never
+// nil.
+func readUsage(tx engine.Tx, u *Usage) error {
+	if bucket := tx.Bucket(usageBucket); bucket != nil {
+		if data := bucket.Get(usageKey); data != nil {
+			if err := Decode(data, u); err != nil {
+				return err
+			}
+		}
+	}
+	if u.Items == nil {
+		u.Items = make(map[string]int64)
+	}
+	return nil
+}
+
+// copyUsage copies the usage recorded in a tenant data file to the system
+// data file. The copy is read while writing it so, on Badger, copies of the
+// same tenant conflict and the copy committed last has the latest usage.
+func (db *DB) copyUsage(tenantID []byte) error {
+	file, p, err := db.leaseTenant(tenantID)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return db.withTransaction(db.path[SystemFile], true, func(tx engine.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(usageBucket)
+		if err != nil {
+			return err
+		}
+		bucket.Get(tenantID)
+
+		u := &Usage{}
+		err = file.View(func(tx engine.Tx) error {
+			return readUsage(tx, u)
+		})
+		if err != nil {
+			return err
+		}
+		if u.FileSize, _, err = dataFileSize(p); err != nil {
+			return err
+		}
+		data, err := Encode(u)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(tenantID, data)
+	})
+}
+
+// moveSystemRecords moves the quota and usage copy of a tenant to a new
+// tenant ID or, if the new ID is nil, removes them.
+func (db *DB) moveSystemRecords(tenantID, newID []byte) error {
+	return db.withTransaction(db.path[SystemFile], true, func(tx engine.Tx) error {
+		for _, name := range [][]byte{quotaBucket, usageBucket} {
+			bucket := tx.Bucket(name)
+			if bucket == nil {
+				continue
+			}
+			data := bucket.Get(tenantID)
+			if data == nil {
+				continue
+			}
+			if newID != nil {
+				if err := bucket.Put(newID, data); err != nil {
+					return err
+				}
+			}
+			if err := bucket.Delete(tenantID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// readSystem decodes the value at a key in a system data file bucket. The
+// value is unchanged if the bucket or key doesn't exist.
+func readSystem(tx engine.Tx, bucketName, k []byte, v interface{}) error {
+	bucket := tx.Bucket(bucketName)
+	if bucket == nil {
+		return nil
+	}
+	data := bucket.Get(k)
+	if data == nil {
+		return nil
+	}
+	return Decode(data, v)
+}
+
+// check returns a QuotaError if adding another item would exceed the quota.
+func (u *txUsage) check() error {
+	var items int64
+	for _, n := range u.used.Items {
+		items += n
+	}
+	for _, n := range u.items {
+		items += n
+	}
+	q := u.quota
+
+	switch {
+	case q.MaxItems > 0 && items >= q.MaxItems:
+		return &QuotaError{TenantID: u.tenantID, Limit: "MaxItems", Used: items, Max: q.MaxItems}
+	case q.MaxBytesWritten > 0 && u.used.BytesWritten+u.written >= q.MaxBytesWritten:
+		return &QuotaError{TenantID: u.tenantID, Limit: "MaxBytesWritten", Used: u.used.BytesWritten + u.written, Max: q.MaxBytesWritten}
+	case q.MaxFileSize > 0 && u.fileSize >= q.MaxFileSize:
+		return &QuotaError{TenantID: u.tenantID, Limit: "MaxFileSize", Used: u.fileSize, Max: q.MaxFileSize}
+	}
+	return nil
+}
+
+// add records a change in the number of items in a bucket and the bytes
+// written.
+func (u *txUsage) add(bucketName []byte, items int64, written int) {
+	if items != 0 {
+		u.items[string(bucketName)] += items
+	}
+	u.written += int64(written)
+}
+
+// changed indicates whether the transaction changed usage.
+func (u *txUsage) changed() bool {
+	return len(u.items) > 0 || u.written != 0
+}
+
+// record writes the usage changed by the transaction to the tenant data file
+// in the same transaction.
+func (u *txUsage) record(tx engine.Tx) error {
+	if !u.changed() {
+		return nil
+	}
+	used := Usage{Items: u.used.Items, BytesWritten: u.used.BytesWritten + u.written}
+
+	for name, n := range u.items {
+		used.Items[name] += n
+		if used.Items[name] <= 0 {
+			// items written before usage was recorded aren't counted
+			delete(used.Items, name)
+		}
+	}
+	bucket, err := tx.CreateBucketIfNotExists(usageBucket)
+	if err != nil {
+		return err
+	}
+	data, err := Encode(used)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(usageKey, data)
+}
+
+// dataFileSize returns the bytes a data file uses on disk and when it was
+// last modified. Engines like Badger store a data file as a directory so
+// every file within it is included.
+func dataFileSize(p string) (int64, time.Time, error) {
+	stat, err := os.Stat(p)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if !stat.IsDir() {
+		return stat.Size(), stat.ModTime(), nil
+	}
+	var size int64
+	modified := stat.ModTime()
+
+	err = filepath.Walk(p, func(_ string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.IsDir() {
+			return nil
+		}
+		size += f.Size()
+		if f.ModTime().After(modified) {
+			modified = f.ModTime()
+		}
+		return nil
+	})
+	return size, modified, err
+}
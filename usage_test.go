@@ -0,0 +1,174 @@
+package pbdb_test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	db "github.com/toba/pbdb"
+	"github.com/toba/pbdb/key"
+)
+
+func TestTenantUsage(t *testing.T) {
+	withDatabase(t, func(t *testing.T, d *db.DB) {
+		tenantID, err := d.CreateTenant()
+		assert.NoError(t, err)
+
+		usage, err := d.TenantUsage(tenantID)
+		assert.NoError(t, err)
+		assert.Empty(t, usage.Items)
+		assert.Zero(t, usage.BytesWritten)
+
+		k, err := d.TenantAdd(tenantID, &TestSchema{Name: "one"})
+		assert.NoError(t, err)
+		_, err = d.TenantAdd(tenantID, &TestSchema{Name: "two"})
+		assert.NoError(t, err)
+		_, err = d.TenantAdd(tenantID, &TestLog{Message: "log"})
+		assert.NoError(t, err)
+
+		usage, err = d.TenantUsage(tenantID)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int64{string(bucketName): 2, "TestLog": 1}, usage.Items)
+		assert.Equal(t, int64(3), usage.ItemCount())
+		assert.True(t, usage.BytesWritten > 0)
+		assert.True(t, usage.FileSize > 0)
+
+		// updates add bytes written without adding items
+		written := usage.BytesWritten
+		assert.NoError(t, d.TenantUpdate(tenantID, k, &TestSchema{Name: "uno"}))
+		assert.NoError(t, d.TenantDelete(tenantID, k, &TestSchema{}))
+		_, err = d.TenantDeleteMatching(tenantID, &TestLog{Message: "log"})
+		assert.NoError(t, err)
+
+		usage, err = d.TenantUsage(tenantID)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int64{string(bucketName): 1}, usage.Items)
+		assert.True(t, usage.BytesWritten > written)
+
+		// usage is copied to the system file and moves with the tenant
+		assert.Equal(t, map[string]int64{key.ToString(tenantID): 1}, usageCopies(t, d))
+		renamed, err := key.Create()
+		assert.NoError(t, err)
+		assert.NoError(t, d.RenameTenant(tenantID, renamed))
+		assert.Equal(t, map[string]int64{key.ToString(renamed): 1}, usageCopies(t, d))
+
+		assert.NoError(t, d.DeleteTenant(renamed))
+		_, err = d.TenantUsage(renamed)
+		assert.Equal(t, db.ErrTenantNotFound, err)
+		assert.Empty(t, usageCopies(t, d))
+	})
+}
+
+// usageCopies returns the item count of each tenant usage copied to the
+// system file by tenant ID.
+func usageCopies(t *testing.T, d *db.DB) map[string]int64 {
+	counts := make(map[string]int64)
+	err := d.ForEachTenantUsage(func(tenantID []byte, u *db.Usage) error {
+		assert.True(t, u.FileSize > 0)
+		counts[key.ToString(tenantID)] = u.ItemCount()
+		return nil
+	})
+	assert.NoError(t, err)
+	return counts
+}
+
+func TestTenantQuota(t *testing.T) {
+	withDatabase(t, func(t *testing.T, d *db.DB) {
+		tenantID, err := d.CreateTenant()
+		assert.NoError(t, err)
+
+		q, err := d.TenantQuota(tenantID)
+		assert.NoError(t, err)
+		assert.Equal(t, db.Quota{}, q)
+
+		assert.NoError(t, d.SetTenantQuota(tenantID, db.Quota{MaxItems: 2}))
+		q, err = d.TenantQuota(tenantID)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), q.MaxItems)
+
+		k, err := d.TenantAdd(tenantID, &TestLog{Message: "one"})
+		assert.NoError(t, err)
+		_, err = d.TenantAdd(tenantID, &TestLog{Message: "two"})
+		assert.NoError(t, err)
+
+		_, err = d.TenantAdd(tenantID, &TestLog{Message: "three"})
+		assert.True(t, errors.Is(err, db.ErrQuotaExceeded))
+		var qe *db.QuotaError
+		assert.True(t, errors.As(err, &qe))
+		assert.Equal(t, "MaxItems", qe.Limit)
+		assert.Equal(t, int64(2), qe.Used)
+
+		// updates are allowed at the limit and deletes make room
+		assert.NoError(t, d.TenantUpdate(tenantID, k, &TestLog{Message: "uno"}))
+		assert.NoError(t, d.TenantDelete(tenantID, k, &TestLog{}))
+		_, err = d.TenantAdd(tenantID, &TestLog{Message: "three"})
+		assert.NoError(t, err)
+
+		// updating a missing item adds it so is also limited
+		missing, err := key.Create()
+		assert.NoError(t, err)
+		err = d.TenantUpdate(tenantID, missing, &TestLog{Message: "four"})
+		assert.True(t, errors.Is(err, db.ErrQuotaExceeded))
+
+		// items added in the same transaction count toward the quota
+		assert.NoError(t, d.SetTenantQuota(tenantID, db.Quota{MaxItems: 3}))
+		err = d.TenantWriter(tenantID, func(tx *db.Tx) error {
+			if _, err := tx.Add(&TestLog{Message: "four"}); err != nil {
+				return err
+			}
+			_, err := tx.Add(&TestLog{Message: "five"})
+			return err
+		})
+		assert.True(t, errors.Is(err, db.ErrQuotaExceeded))
+
+		usage, err := d.TenantUsage(tenantID)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), usage.ItemCount())
+
+		assert.NoError(t, d.SetTenantQuota(tenantID, db.Quota{}))
+		_, err = d.TenantAdd(tenantID, &TestLog{Message: "four"})
+		assert.NoError(t, err)
+	})
+}
+
+func TestTenantQuotaConcurrently(t *testing.T) {
+	withDatabase(t, func(t *testing.T, d *db.DB) {
+		tenantID, err := d.CreateTenant()
+		assert.NoError(t, err)
+		assert.NoError(t, d.SetTenantQuota(tenantID, db.Quota{MaxItems: 5}))
+
+		var wg sync.WaitGroup
+		errs := make([]error, 20)
+
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, errs[i] = d.TenantAdd(tenantID, &TestLog{Message: fmt.Sprint(i)})
+			}(i)
+		}
+		wg.Wait()
+
+		added := 0
+		for _, err := range errs {
+			if err == nil {
+				added++
+			} else {
+				assert.True(t, errors.Is(err, db.ErrQuotaExceeded), "unexpected error %v", err)
+			}
+		}
+		assert.Equal(t, 5, added)
+
+		usage, err := d.TenantUsage(tenantID)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(5), usage.ItemCount())
+		assert.Equal(t, map[string]int64{key.ToString(tenantID): 5}, usageCopies(t, d))
+
+		info, err := d.TenantInfo(tenantID)
+		assert.NoError(t, err)
+		assert.Equal(t, 5, info.Buckets["TestLog"])
+	})
+}
@@ -0,0 +1,297 @@
+package pbdb
+
+import (
+	"sort"
+
+	"github.com/toba/pbdb/index"
+	"github.com/toba/pbdb/store"
+)
+
+type (
+	// IndexProblem is a kind of inconsistency between items and their
+	// indexes.
+	IndexProblem int
+
+	// IndexIssue is an index entry that disagrees with the stored items.
+	IndexIssue struct {
+		Problem IndexProblem
+		// Index is the index bucket name.
+		Index []byte
+		Value []byte
+		// ItemKey is the item the entry refers to or should refer to.
+		ItemKey []byte
+		// Holder is the item already indexed to the value of a
+		// ConflictingEntry.
+		Holder []byte
+		// Repaired indicates the entry was added or removed.
+		Repaired bool
+	}
+
+	// IndexReport lists the issues found by VerifyIndexes.
+	IndexReport struct {
+		// Items is the number of items checked.
+		Items int
+		// Entries is the number of index entries checked.
+		Entries int
+		Issues  []IndexIssue
+	}
+
+	// indexEntry is an index value and item key pair.
+	indexEntry struct{ value, item string }
+
+	// expectedIndex is the entries an index should have according to the
+	// stored items.
+	expectedIndex struct {
+		unique bool
+		// items lists the keys of the items with each value.
+		items map[string][]string
+	}
+)
+
+const (
+	// MissingEntry is an item value that isn't indexed.
+	MissingEntry IndexProblem = iota
+	// OrphanedEntry is an index entry for an item that doesn't exist or
+	// doesn't have the indexed value.
+	OrphanedEntry
+	// ConflictingEntry is a value in a unique index that belongs to more
+	// than one item. It can't be repaired since only one item may be
+	// indexed.
+	ConflictingEntry
+)
+
+// String returns the problem name.
+func (p IndexProblem) String() string {
+	switch p {
+	case MissingEntry:
+		return "missing"
+	case OrphanedEntry:
+		return "orphaned"
+	case ConflictingEntry:
+		return "conflicting"
+	}
+	return "unknown"
+}
+
+// OK indicates every issue found was repaired.
+func (r *IndexReport) OK() bool {
+	for _, i := range r.Issues {
+		if !i.Repaired {
+			return false
+		}
+	}
+	return true
+}
+
+// VerifyIndexes compares the indexes of a data file with the index maps of
+// its items. Each example value identifies an item bucket to check and the
+// type its items are decoded as. Every index returned by those items, and
+// every catalog index of their buckets, is checked for missing, orphaned and
+// conflicting entries.
+//
+// If repair is true then, in the same transaction, orphaned entries are
+// removed and missing entries added. Conflicts are only reported.
+func (db *DB) VerifyIndexes(f DataFile, repair bool, examples ...store.Value) (*IndexReport, error) {
+	if repair {
+		return verifyIndexes(func(fn TxFunc) error { return db.Update(f, fn) }, repair, examples)
+	}
+	return verifyIndexes(func(fn TxFunc) error { return db.View(f, fn) }, repair, examples)
+}
+
+// TenantVerifyIndexes compares the indexes of a tenant data file with the
+// index maps of its items, as for VerifyIndexes.
+func (db *DB) TenantVerifyIndexes(tenantID []byte, repair bool, examples ...store.Value) (*IndexReport, error) {
+	if repair {
+		return verifyIndexes(func(fn TxFunc) error { return db.TenantWriter(tenantID, fn) }, repair, examples)
+	}
+	return verifyIndexes(func(fn TxFunc) error { return db.TenantReader(tenantID, fn) }, repair, examples)
+}
+
+// verifyIndexes checks indexes within a transaction started by transact. The
+// function may be executed again on Badger so each execution starts a new
+// report and only the report of the last is returned.
+func verifyIndexes(transact func(TxFunc) error, repair bool, examples []store.Value) (*IndexReport, error) {
+	var report *IndexReport
+
+	err := transact(func(tx *Tx) error {
+		r := &IndexReport{}
+		if err := tx.verifyIndexes(r, repair, examples); err != nil {
+			return err
+		}
+		report = r
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// verifyIndexes adds the issues with the indexes of each example's bucket to
+// a report, repairing them if requested.
+func (tx *Tx) verifyIndexes(report *IndexReport, repair bool, examples []store.Value) error {
+	for _, example := range examples {
+		expected, err := tx.expectedIndexes(report, example)
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(expected))
+		for name := range expected {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if err := tx.verifyIndex(report, repair, []byte(name), expected[name]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// expectedIndexes returns the entries each index should have according to
+// the items in the bucket of an example value. Catalog indexes without
+// entries are included so their orphans are found.
+func (tx *Tx) expectedIndexes(report *IndexReport, example store.Value) (map[string]*expectedIndex, error) {
+	expected := make(map[string]*expectedIndex)
+	name := example.BucketName()
+
+	catalog, err := index.Catalog(tx.tx, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range catalog {
+		expected[string(info.Name)] = &expectedIndex{
+			unique: info.Unique,
+			items:  make(map[string][]string),
+		}
+	}
+	bucket := tx.tx.Bucket(name)
+	if bucket == nil {
+		return expected, nil
+	}
+	c := tx.codecFor(example)
+	if err := checkCodec(tx.tx, name, c, false); err != nil {
+		return nil, err
+	}
+
+	err = bucket.ForEach(func(k, data []byte) error {
+		report.Items++
+		item := newValue(example)
+		if err := c.Unmarshal(data, item); err != nil {
+			return err
+		}
+		for _, d := range item.IndexMap().Definitions {
+			if len(d.Value) == 0 {
+				continue
+			}
+			e, ok := expected[string(d.BucketName)]
+			if !ok {
+				e = &expectedIndex{unique: d.Unique, items: make(map[string][]string)}
+				expected[string(d.BucketName)] = e
+			} else if e.unique != d.Unique {
+				return ErrIndexMismatch
+			}
+			e.items[string(d.Value)] = append(e.items[string(d.Value)], string(k))
+		}
+		return nil
+	})
+	return expected, err
+}
+
+// verifyIndex compares the entries of an index with those expected, adding
+// issues to the report. Orphans are removed before missing entries are added
+// so a unique value can move to the item that should have it.
+func (tx *Tx) verifyIndex(report *IndexReport, repair bool, name []byte, expected *expectedIndex) error {
+	idx := existingIndex(tx.tx, &index.Definition{BucketName: name, Unique: expected.unique})
+	found := make(map[indexEntry]bool)
+	// holders are the items indexed to each unique value
+	holders := make(map[string]string)
+	var orphans []indexEntry
+
+	if idx != nil {
+		err := idx.ForEach(func(value, item []byte) error {
+			report.Entries++
+			e := indexEntry{string(value), string(item)}
+
+			if contains(expected.items[e.value], e.item) {
+				found[e] = true
+			} else {
+				orphans = append(orphans, e)
+			}
+			if expected.unique {
+				holders[e.value] = e.item
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, e := range orphans {
+		issue := IndexIssue{Problem: OrphanedEntry, Index: name, Value: []byte(e.value), ItemKey: []byte(e.item)}
+		if repair {
+			if err := idx.Remove(issue.Value, issue.ItemKey); err != nil {
+				return err
+			}
+			issue.Repaired = true
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+
+	values := make([]string, 0, len(expected.items))
+	for v := range expected.items {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+
+	for _, v := range values {
+		// owner is the item legitimately holding a unique value
+		owner := ""
+		if h, ok := holders[v]; ok && found[indexEntry{v, h}] {
+			owner = h
+		}
+		for _, item := range expected.items[v] {
+			if found[indexEntry{v, item}] || item == owner {
+				continue
+			}
+			issue := IndexIssue{Problem: MissingEntry, Index: name, Value: []byte(v), ItemKey: []byte(item)}
+
+			if expected.unique && owner != "" {
+				issue.Problem = ConflictingEntry
+				issue.Holder = []byte(owner)
+				report.Issues = append(report.Issues, issue)
+				continue
+			}
+			if expected.unique {
+				owner = item
+			}
+			if repair {
+				if idx == nil {
+					var err error
+					if idx, err = makeIndex(tx.tx, name, expected.unique); err != nil {
+						return err
+					}
+				}
+				if err := idx.Add(issue.Value, issue.ItemKey); err != nil {
+					return err
+				}
+				issue.Repaired = true
+			}
+			report.Issues = append(report.Issues, issue)
+		}
+	}
+	return nil
+}
+
+// contains indicates whether a list includes a string.
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
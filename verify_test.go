@@ -0,0 +1,144 @@
+package pbdb_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	db "github.com/toba/pbdb"
+	"github.com/toba/pbdb/engine"
+	"github.com/toba/pbdb/index"
+	"github.com/toba/pbdb/key"
+	"github.com/toba/pbdb/store"
+)
+
+func TestVerifyIndexes(t *testing.T) {
+	withDatabase(t, func(t *testing.T, d *db.DB) {
+		var names [][]byte
+		for _, name := range []string{"a", "b", "c"} {
+			k, err := d.SystemAdd(&TestSchema{Name: name})
+			assert.NoError(t, err)
+			names = append(names, k)
+		}
+		for _, city := range []string{"Paris", "Rome"} {
+			_, err := d.SystemAdd(&TestIndexedPlace{City: city})
+			assert.NoError(t, err)
+		}
+		examples := []store.Value{&TestSchema{}, &TestIndexedPlace{}}
+
+		report, err := d.VerifyIndexes(db.SystemFile, false, examples...)
+		assert.NoError(t, err)
+		assert.Equal(t, 5, report.Items)
+		assert.Equal(t, 5, report.Entries)
+		assert.Empty(t, report.Issues)
+		assert.True(t, report.OK())
+
+		stray, err := key.Create()
+		assert.NoError(t, err)
+		duplicate, err := key.Create()
+		assert.NoError(t, err)
+
+		cn, err := d.OpenDataFile(db.SystemFile)
+		assert.NoError(t, err)
+		err = cn.Update(func(tx engine.Tx) error {
+			unique := index.GetUnique(tx, indexName)
+			if err := unique.RemoveValue([]byte("a")); err != nil {
+				return err
+			}
+			if err := unique.Add([]byte("zz"), stray); err != nil {
+				return err
+			}
+			// a second item with a unique value bypassing the index
+			data, err := db.Encode(&TestSchema{Name: "b"})
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(bucketName).Put(duplicate, data); err != nil {
+				return err
+			}
+			cities := index.GetNonUnique(tx, cityIndex)
+			if err := cities.RemoveValue([]byte("Paris")); err != nil {
+				return err
+			}
+			return cities.Add([]byte("Oslo"), stray)
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, cn.Close())
+
+		expected := []db.IndexIssue{
+			{Problem: db.OrphanedEntry, Index: indexName, Value: []byte("zz"), ItemKey: stray},
+			{Problem: db.MissingEntry, Index: indexName, Value: []byte("a"), ItemKey: names[0]},
+			{Problem: db.ConflictingEntry, Index: indexName, Value: []byte("b"), ItemKey: duplicate, Holder: names[1]},
+			{Problem: db.OrphanedEntry, Index: cityIndex, Value: []byte("Oslo"), ItemKey: stray},
+		}
+		report, err = d.VerifyIndexes(db.SystemFile, false, examples...)
+		assert.NoError(t, err)
+		assert.False(t, report.OK())
+		assert.Equal(t, 6, report.Items)
+		assert.Len(t, report.Issues, 5)
+		assert.Subset(t, report.Issues, expected)
+		assert.Equal(t, db.MissingEntry, report.Issues[4].Problem)
+		assert.Equal(t, []byte("Paris"), report.Issues[4].Value)
+
+		report, err = d.VerifyIndexes(db.SystemFile, true, examples...)
+		assert.NoError(t, err)
+		assert.Len(t, report.Issues, 5)
+		for _, issue := range report.Issues {
+			assert.Equal(t, issue.Problem != db.ConflictingEntry, issue.Repaired, issue.Problem.String())
+		}
+
+		// only the conflict remains
+		report, err = d.VerifyIndexes(db.SystemFile, false, examples...)
+		assert.NoError(t, err)
+		assert.Len(t, report.Issues, 1)
+		assert.Equal(t, db.ConflictingEntry, report.Issues[0].Problem)
+
+		has, err := d.Has(db.SystemFile, &TestSchema{Name: "a"})
+		assert.NoError(t, err)
+		assert.True(t, has)
+	})
+}
+
+func TestVerifyIndexesConcurrently(t *testing.T) {
+	withBadger(t, func(d *db.DB) {
+		const total = 200
+		var first []byte
+
+		for i := 0; i < total; i++ {
+			k, err := d.SystemAdd(&TestIndexedPlace{City: "Paris"})
+			assert.NoError(t, err)
+			if first == nil {
+				first = k
+			}
+		}
+		cn, err := d.OpenDataFile(db.SystemFile)
+		assert.NoError(t, err)
+		defer cn.Close()
+
+		// change the city without its index entry so each repair writes,
+		// stopping well before repairs conflict too often to be retried
+		cities := []string{"Oslo", "Rome"}
+		n := 0
+		stop := repeatConcurrently(t, func() error {
+			if n++; n > 20 {
+				return nil
+			}
+			data, err := db.Encode(&TestIndexedPlace{City: cities[n%2]})
+			if err != nil {
+				return err
+			}
+			return cn.Update(func(tx engine.Tx) error {
+				return tx.Bucket(placeBucket).Put(first, data)
+			})
+		})
+		defer stop()
+
+		// a repair executed again after a conflict reports each item once
+		for i := 0; i < 10; i++ {
+			report, err := d.VerifyIndexes(db.SystemFile, true, &TestIndexedPlace{})
+			assert.NoError(t, err)
+			assert.Equal(t, total, report.Items)
+			assert.True(t, len(report.Issues) <= 2, "%d issues", len(report.Issues))
+		}
+	})
+}